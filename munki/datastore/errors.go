@@ -0,0 +1,12 @@
+package datastore
+
+import "errors"
+
+// ErrNotFound is returned by store methods when the requested manifest,
+// pkgsinfo, or catalog entry does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrTagCycle is returned by TagStore.SaveTag when the requested target
+// would make the tag resolve back into its own chain, directly or through
+// intermediate tags.
+var ErrTagCycle = errors.New("tag target would create a cycle")
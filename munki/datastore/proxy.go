@@ -0,0 +1,287 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/groob/plist"
+	"github.com/micromdm/squirrel/munki/munki"
+	"golang.org/x/sync/singleflight"
+)
+
+// Upstream fetches raw manifest and pkgsinfo bytes from a remote
+// munki_repo, e.g. over HTTP or from an S3 bucket. Implementations are
+// only responsible for retrieving the bytes; ProxyManifestStore and
+// ProxyPkgsinfoStore handle caching and decoding.
+type Upstream interface {
+	FetchManifest(name string) ([]byte, error)
+	FetchPkgsinfo(name string) ([]byte, error)
+}
+
+// ProxyConfig holds the `proxy:` section of the server config: where to
+// pull manifests through from, and how long a pulled-through copy stays
+// cached locally before it is evicted and re-fetched.
+type ProxyConfig struct {
+	UpstreamURL string
+	Username    string
+	Password    string
+	TTL         time.Duration
+	CacheDir    string
+	ScheduleDB  string
+}
+
+// HTTPUpstream fetches manifests from a remote squirrel/munki_repo over
+// plain HTTP(S).
+type HTTPUpstream struct {
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+}
+
+// NewHTTPUpstream returns an Upstream backed by an HTTP munki_repo server.
+func NewHTTPUpstream(baseURL, username, password string) *HTTPUpstream {
+	return &HTTPUpstream{baseURL: baseURL, username: username, password: password, client: http.DefaultClient}
+}
+
+func (u *HTTPUpstream) FetchManifest(name string) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.baseURL+"/manifests/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.username != "" {
+		req.SetBasicAuth(u.username, u.password)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch manifest %q: upstream returned %s", name, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (u *HTTPUpstream) FetchPkgsinfo(name string) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.baseURL+"/pkgsinfo/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.username != "" {
+		req.SetBasicAuth(u.username, u.password)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch pkgsinfo %q: upstream returned %s", name, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// ProxyManifestStore is a munki.ManifestStore that pulls manifests through
+// from an Upstream repo on a local cache miss, writes them into a local
+// cache store, and schedules the cached copy for eviction after a TTL.
+// Concurrent misses for the same name are coalesced into a single upstream
+// fetch.
+type ProxyManifestStore struct {
+	upstream Upstream
+	local    munki.ManifestStore
+	ttl      time.Duration
+	sched    *evictionScheduler
+	group    singleflight.Group
+}
+
+// NewProxyManifestStore wires upstream to local, evicting cached entries
+// from local after ttl. scheduleDB is the path used to persist pending
+// evictions so they survive a restart.
+func NewProxyManifestStore(upstream Upstream, local munki.ManifestStore, ttl time.Duration, scheduleDB string, logger kitlog.Logger) (*ProxyManifestStore, error) {
+	sched, err := newEvictionScheduler(scheduleDB, logger)
+	if err != nil {
+		return nil, err
+	}
+	s := &ProxyManifestStore{
+		upstream: upstream,
+		local:    local,
+		ttl:      ttl,
+		sched:    sched,
+	}
+	sched.start(func(name string) {
+		local.DeleteManifest(name)
+	})
+	return s, nil
+}
+
+// Manifest returns the local copy if present, otherwise pulls it through
+// from upstream, caches it locally, and schedules it for eviction.
+func (s *ProxyManifestStore) Manifest(name string) (munki.Manifest, error) {
+	if m, err := s.local.Manifest(name); err == nil {
+		return m, nil
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	v, err, _ := s.group.Do(name, func() (interface{}, error) {
+		return s.pullThrough(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(munki.Manifest), nil
+}
+
+func (s *ProxyManifestStore) pullThrough(name string) (munki.Manifest, error) {
+	body, err := s.upstream.FetchManifest(name)
+	if err != nil {
+		return nil, err
+	}
+	m, err := munki.UnmarshalManifest("application/x-apple-plist", body)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.local.SaveManifest(name, m); err != nil {
+		return nil, err
+	}
+	s.sched.schedule(name, s.ttl)
+	return m, nil
+}
+
+func (s *ProxyManifestStore) AllManifests() (*munki.ManifestCollection, error) {
+	return s.local.AllManifests()
+}
+
+func (s *ProxyManifestStore) NewManifest(name string) (munki.Manifest, error) {
+	return s.local.NewManifest(name)
+}
+
+func (s *ProxyManifestStore) SaveManifest(path string, manifest munki.Manifest) error {
+	if err := s.local.SaveManifest(path, manifest); err != nil {
+		return err
+	}
+	s.sched.cancel(path)
+	return nil
+}
+
+func (s *ProxyManifestStore) DeleteManifest(name string) error {
+	s.sched.cancel(name)
+	return s.local.DeleteManifest(name)
+}
+
+func (s *ProxyManifestStore) ManifestDigest(name string) (string, error) {
+	return s.local.ManifestDigest(name)
+}
+
+// Close stops the eviction scheduler's background goroutine.
+func (s *ProxyManifestStore) Close() error {
+	return s.sched.Close()
+}
+
+// ProxyPkgsinfoStore is a munki.PkgsinfoStore that pulls pkgsinfo through
+// from an Upstream repo on a local cache miss, the pkgsinfo-side
+// counterpart to ProxyManifestStore. It shares the same pull-through,
+// cache, and TTL-eviction behavior, including singleflight coalescing of
+// concurrent misses for the same name.
+type ProxyPkgsinfoStore struct {
+	upstream Upstream
+	local    munki.PkgsinfoStore
+	ttl      time.Duration
+	sched    *evictionScheduler
+	group    singleflight.Group
+}
+
+// NewProxyPkgsinfoStore wires upstream to local, evicting cached entries
+// from local after ttl. scheduleDB is the path used to persist pending
+// evictions so they survive a restart.
+func NewProxyPkgsinfoStore(upstream Upstream, local munki.PkgsinfoStore, ttl time.Duration, scheduleDB string, logger kitlog.Logger) (*ProxyPkgsinfoStore, error) {
+	sched, err := newEvictionScheduler(scheduleDB, logger)
+	if err != nil {
+		return nil, err
+	}
+	s := &ProxyPkgsinfoStore{
+		upstream: upstream,
+		local:    local,
+		ttl:      ttl,
+		sched:    sched,
+	}
+	sched.start(func(name string) {
+		local.DeletePkgsinfo(name)
+	})
+	return s, nil
+}
+
+// Pkgsinfo returns the local copy if present, otherwise pulls it through
+// from upstream, caches it locally, and schedules it for eviction.
+func (s *ProxyPkgsinfoStore) Pkgsinfo(name string) (*munki.Pkgsinfo, error) {
+	if p, err := s.local.Pkgsinfo(name); err == nil {
+		return p, nil
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	v, err, _ := s.group.Do(name, func() (interface{}, error) {
+		return s.pullThrough(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*munki.Pkgsinfo), nil
+}
+
+func (s *ProxyPkgsinfoStore) pullThrough(name string) (*munki.Pkgsinfo, error) {
+	body, err := s.upstream.FetchPkgsinfo(name)
+	if err != nil {
+		return nil, err
+	}
+	var p munki.Pkgsinfo
+	if err := plist.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	p.Filename = name
+	if err := s.local.SavePkgsinfo(name, &p); err != nil {
+		return nil, err
+	}
+	s.sched.schedule(name, s.ttl)
+	return &p, nil
+}
+
+func (s *ProxyPkgsinfoStore) AllPkgsinfos() (*munki.PkgsinfoCollection, error) {
+	return s.local.AllPkgsinfos()
+}
+
+func (s *ProxyPkgsinfoStore) NewPkgsinfo(name string) (*munki.Pkgsinfo, error) {
+	return s.local.NewPkgsinfo(name)
+}
+
+func (s *ProxyPkgsinfoStore) SavePkgsinfo(path string, info *munki.Pkgsinfo) error {
+	if err := s.local.SavePkgsinfo(path, info); err != nil {
+		return err
+	}
+	s.sched.cancel(path)
+	return nil
+}
+
+func (s *ProxyPkgsinfoStore) DeletePkgsinfo(name string) error {
+	s.sched.cancel(name)
+	return s.local.DeletePkgsinfo(name)
+}
+
+func (s *ProxyPkgsinfoStore) PkgsinfoDigest(name string) (string, error) {
+	return s.local.PkgsinfoDigest(name)
+}
+
+// Close stops the eviction scheduler's background goroutine.
+func (s *ProxyPkgsinfoStore) Close() error {
+	return s.sched.Close()
+}
@@ -0,0 +1,329 @@
+package datastore
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/micromdm/squirrel/munki/munki"
+)
+
+// fakeLocalStore is an in-memory munki.ManifestStore standing in for the
+// cache ProxyManifestStore writes pulled-through manifests into.
+type fakeLocalStore struct {
+	mu     sync.Mutex
+	byName map[string]munki.Manifest
+}
+
+func newFakeLocalStore() *fakeLocalStore {
+	return &fakeLocalStore{byName: make(map[string]munki.Manifest)}
+}
+
+func (f *fakeLocalStore) AllManifests() (*munki.ManifestCollection, error) {
+	var all munki.ManifestCollection
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range f.byName {
+		all = append(all, m)
+	}
+	return &all, nil
+}
+
+func (f *fakeLocalStore) Manifest(name string) (munki.Manifest, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.byName[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return m, nil
+}
+
+func (f *fakeLocalStore) NewManifest(name string) (munki.Manifest, error) {
+	return &munki.ManifestV1{Filename: name}, nil
+}
+
+func (f *fakeLocalStore) SaveManifest(path string, m munki.Manifest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.byName[path] = m
+	return nil
+}
+
+func (f *fakeLocalStore) DeleteManifest(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.byName, name)
+	return nil
+}
+
+func (f *fakeLocalStore) ManifestDigest(name string) (string, error) {
+	m, err := f.Manifest(name)
+	if err != nil {
+		return "", err
+	}
+	return munki.Digest(m)
+}
+
+// blockingUpstream counts FetchManifest calls and waits on release before
+// returning, so a test can hold several concurrent callers in flight at
+// once to exercise singleflight coalescing.
+type blockingUpstream struct {
+	calls   int32
+	body    []byte
+	release chan struct{}
+}
+
+func (u *blockingUpstream) FetchManifest(name string) ([]byte, error) {
+	atomic.AddInt32(&u.calls, 1)
+	<-u.release
+	return u.body, nil
+}
+
+func (u *blockingUpstream) FetchPkgsinfo(name string) ([]byte, error) {
+	atomic.AddInt32(&u.calls, 1)
+	<-u.release
+	return u.body, nil
+}
+
+func plistBody(t *testing.T, m *munki.ManifestV1) []byte {
+	t.Helper()
+	_, data, err := m.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// fakeLocalPkgsinfoStore is an in-memory munki.PkgsinfoStore standing in
+// for the cache ProxyPkgsinfoStore writes pulled-through pkgsinfo into.
+type fakeLocalPkgsinfoStore struct {
+	mu     sync.Mutex
+	byName map[string]*munki.Pkgsinfo
+}
+
+func newFakeLocalPkgsinfoStore() *fakeLocalPkgsinfoStore {
+	return &fakeLocalPkgsinfoStore{byName: make(map[string]*munki.Pkgsinfo)}
+}
+
+func (f *fakeLocalPkgsinfoStore) AllPkgsinfos() (*munki.PkgsinfoCollection, error) {
+	var all munki.PkgsinfoCollection
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.byName {
+		all = append(all, p)
+	}
+	return &all, nil
+}
+
+func (f *fakeLocalPkgsinfoStore) Pkgsinfo(name string) (*munki.Pkgsinfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.byName[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+func (f *fakeLocalPkgsinfoStore) NewPkgsinfo(name string) (*munki.Pkgsinfo, error) {
+	return &munki.Pkgsinfo{Filename: name}, nil
+}
+
+func (f *fakeLocalPkgsinfoStore) SavePkgsinfo(path string, info *munki.Pkgsinfo) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.byName[path] = info
+	return nil
+}
+
+func (f *fakeLocalPkgsinfoStore) DeletePkgsinfo(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.byName, name)
+	return nil
+}
+
+func (f *fakeLocalPkgsinfoStore) PkgsinfoDigest(name string) (string, error) {
+	p, err := f.Pkgsinfo(name)
+	if err != nil {
+		return "", err
+	}
+	return p.Digest()
+}
+
+func TestProxyManifestStoreCacheHitSkipsUpstream(t *testing.T) {
+	local := newFakeLocalStore()
+	local.byName["site-a"] = &munki.ManifestV1{Filename: "site-a"}
+	upstream := &blockingUpstream{release: make(chan struct{})}
+	close(upstream.release)
+
+	store, err := NewProxyManifestStore(upstream, local, time.Hour, filepath.Join(t.TempDir(), "sched.json"), kitlog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, err := store.Manifest("site-a"); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&upstream.calls) != 0 {
+		t.Errorf("FetchManifest called %d times on a cache hit, want 0", upstream.calls)
+	}
+}
+
+func TestProxyManifestStorePullsThroughOnMiss(t *testing.T) {
+	local := newFakeLocalStore()
+	upstream := &blockingUpstream{release: make(chan struct{})}
+	close(upstream.release)
+	upstream.body = plistBody(t, &munki.ManifestV1{Filename: "site-b", DisplayName: "Site B"})
+
+	store, err := NewProxyManifestStore(upstream, local, time.Hour, filepath.Join(t.TempDir(), "sched.json"), kitlog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	m, err := store.Manifest("site-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := m.(*munki.ManifestV1)
+	if v1.DisplayName != "Site B" {
+		t.Errorf("DisplayName = %q, want %q", v1.DisplayName, "Site B")
+	}
+	if _, err := local.Manifest("site-b"); err != nil {
+		t.Errorf("pulled-through manifest was not cached locally: %v", err)
+	}
+}
+
+func TestProxyManifestStoreCoalescesConcurrentMisses(t *testing.T) {
+	local := newFakeLocalStore()
+	upstream := &blockingUpstream{release: make(chan struct{})}
+	upstream.body = plistBody(t, &munki.ManifestV1{Filename: "site-c"})
+
+	store, err := NewProxyManifestStore(upstream, local, time.Hour, filepath.Join(t.TempDir(), "sched.json"), kitlog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make([]error, callers)
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = store.Manifest("site-c")
+		}(i)
+	}
+
+	// give every goroutine a chance to reach the singleflight group before
+	// the upstream fetch is allowed to complete.
+	time.Sleep(20 * time.Millisecond)
+	close(upstream.release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("caller %d: %v", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(&upstream.calls); got != 1 {
+		t.Errorf("FetchManifest called %d times for %d concurrent misses, want 1", got, callers)
+	}
+}
+
+func TestProxyPkgsinfoStoreCacheHitSkipsUpstream(t *testing.T) {
+	local := newFakeLocalPkgsinfoStore()
+	local.byName["firefox"] = &munki.Pkgsinfo{Filename: "firefox", Name: "Firefox"}
+	upstream := &blockingUpstream{release: make(chan struct{})}
+	close(upstream.release)
+
+	store, err := NewProxyPkgsinfoStore(upstream, local, time.Hour, filepath.Join(t.TempDir(), "sched.json"), kitlog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, err := store.Pkgsinfo("firefox"); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&upstream.calls) != 0 {
+		t.Errorf("FetchPkgsinfo called %d times on a cache hit, want 0", upstream.calls)
+	}
+}
+
+func TestProxyPkgsinfoStorePullsThroughOnMiss(t *testing.T) {
+	local := newFakeLocalPkgsinfoStore()
+	upstream := &blockingUpstream{release: make(chan struct{})}
+	close(upstream.release)
+	want := &munki.Pkgsinfo{Name: "Chrome", Version: "1.0"}
+	_, body, err := want.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.body = body
+
+	store, err := NewProxyPkgsinfoStore(upstream, local, time.Hour, filepath.Join(t.TempDir(), "sched.json"), kitlog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	p, err := store.Pkgsinfo("chrome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "Chrome" || p.Version != "1.0" {
+		t.Errorf("Pkgsinfo = %+v, want Name=Chrome Version=1.0", p)
+	}
+	if _, err := local.Pkgsinfo("chrome"); err != nil {
+		t.Errorf("pulled-through pkgsinfo was not cached locally: %v", err)
+	}
+}
+
+func TestProxyPkgsinfoStoreCoalescesConcurrentMisses(t *testing.T) {
+	local := newFakeLocalPkgsinfoStore()
+	upstream := &blockingUpstream{release: make(chan struct{})}
+	want := &munki.Pkgsinfo{Name: "Safari"}
+	_, body, err := want.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.body = body
+
+	store, err := NewProxyPkgsinfoStore(upstream, local, time.Hour, filepath.Join(t.TempDir(), "sched.json"), kitlog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make([]error, callers)
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = store.Pkgsinfo("safari")
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(upstream.release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("caller %d: %v", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(&upstream.calls); got != 1 {
+		t.Errorf("FetchPkgsinfo called %d times for %d concurrent misses, want 1", got, callers)
+	}
+}
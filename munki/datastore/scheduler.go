@@ -0,0 +1,169 @@
+package datastore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+)
+
+// evictEntry is a single pending eviction tracked by the scheduler.
+type evictEntry struct {
+	Name      string        `json:"name"`
+	FetchedAt time.Time     `json:"fetched_at"`
+	TTL       time.Duration `json:"ttl"`
+}
+
+func (e evictEntry) deadline() time.Time {
+	return e.FetchedAt.Add(e.TTL)
+}
+
+// evictionScheduler tracks (name, fetchedAt, TTL) entries for a proxy cache
+// and invokes a removal callback once an entry's TTL has elapsed. The
+// schedule is persisted to disk so pending evictions survive a restart.
+type evictionScheduler struct {
+	path   string
+	logger kitlog.Logger
+
+	mu      sync.Mutex
+	entries map[string]evictEntry
+
+	stop chan struct{}
+}
+
+// newEvictionScheduler loads any previously persisted schedule from path,
+// or starts with an empty schedule if the file does not exist yet.
+func newEvictionScheduler(path string, logger kitlog.Logger) (*evictionScheduler, error) {
+	s := &evictionScheduler{
+		path:    path,
+		logger:  logger,
+		entries: make(map[string]evictEntry),
+		stop:    make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *evictionScheduler) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []evictEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		s.entries[e.Name] = e
+	}
+	return nil
+}
+
+// persist writes the current schedule to disk via a temp file + rename so a
+// crash mid-write can never leave a corrupt schedule file behind. Callers
+// must hold s.mu.
+func (s *evictionScheduler) persist() error {
+	entries := make([]evictEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.path, data)
+}
+
+// schedule records that name was fetched just now and should be evicted
+// after ttl elapses, overwriting any existing schedule for name.
+func (s *evictionScheduler) schedule(name string, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[name] = evictEntry{Name: name, FetchedAt: time.Now(), TTL: ttl}
+	if err := s.persist(); err != nil {
+		s.logger.Log("component", "proxy-scheduler", "err", err)
+	}
+}
+
+// cancel removes any pending eviction for name, e.g. after it has been
+// evicted, or saved or deleted through the proxy store directly.
+func (s *evictionScheduler) cancel(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, name)
+	if err := s.persist(); err != nil {
+		s.logger.Log("component", "proxy-scheduler", "err", err)
+	}
+}
+
+// start runs a goroutine that wakes periodically, evicts every entry whose
+// TTL has elapsed by invoking remove, and drops it from the schedule.
+func (s *evictionScheduler) start(remove func(name string)) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sweep(remove)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *evictionScheduler) sweep(remove func(name string)) {
+	now := time.Now()
+	var expired []string
+	s.mu.Lock()
+	for name, e := range s.entries {
+		if now.After(e.deadline()) {
+			expired = append(expired, name)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, name := range expired {
+		remove(name)
+		s.cancel(name)
+		s.logger.Log("component", "proxy-scheduler", "evicted", name)
+	}
+}
+
+func (s *evictionScheduler) Close() error {
+	close(s.stop)
+	return nil
+}
+
+// writeFileAtomically writes data to path by writing to a temp file in the
+// same directory and renaming it over path, so readers never observe a
+// partially written file.
+func writeFileAtomically(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,102 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+)
+
+func TestWriteFileAtomically(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+
+	if err := writeFileAtomically(path, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first" {
+		t.Errorf("contents = %q, want %q", data, "first")
+	}
+
+	if err := writeFileAtomically(path, []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "second" {
+		t.Errorf("contents after overwrite = %q, want %q", data, "second")
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("dir has %d entries after write, want 1 (no leftover temp file): %v", len(entries), entries)
+	}
+}
+
+func TestEvictionSchedulerSweep(t *testing.T) {
+	dir := t.TempDir()
+	sched, err := newEvictionScheduler(filepath.Join(dir, "schedule.json"), kitlog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sched.schedule("expired", time.Millisecond)
+	sched.schedule("fresh", time.Hour)
+	time.Sleep(5 * time.Millisecond)
+
+	var removed []string
+	sched.sweep(func(name string) {
+		removed = append(removed, name)
+	})
+
+	if len(removed) != 1 || removed[0] != "expired" {
+		t.Errorf("removed = %v, want [expired]", removed)
+	}
+
+	sched.mu.Lock()
+	_, stillScheduled := sched.entries["expired"]
+	_, freshStillScheduled := sched.entries["fresh"]
+	sched.mu.Unlock()
+	if stillScheduled {
+		t.Error("expired entry was not removed from the schedule after sweep")
+	}
+	if !freshStillScheduled {
+		t.Error("fresh entry was removed from the schedule before its TTL elapsed")
+	}
+}
+
+func TestEvictionSchedulerPersistsAcrossReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	sched, err := newEvictionScheduler(path, kitlog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched.schedule("site-a", time.Hour)
+
+	reloaded, err := newEvictionScheduler(path, kitlog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded.mu.Lock()
+	_, ok := reloaded.entries["site-a"]
+	reloaded.mu.Unlock()
+	if !ok {
+		t.Error("reloaded scheduler lost the persisted entry for site-a")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+}
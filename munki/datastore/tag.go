@@ -0,0 +1,170 @@
+package datastore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/micromdm/squirrel/munki/munki"
+)
+
+// FileTagStore is a munki.TagStore that persists tag -> target mappings
+// (and each tag's history) as a single JSON file, written via a temp
+// file + rename so a crash mid-write never corrupts it. Digest lookups are
+// served by scanning manifests, the same way a small munki_repo would.
+type FileTagStore struct {
+	path      string
+	manifests munki.ManifestStore
+
+	mu      sync.Mutex
+	tags    map[string]*munki.Tag
+	history map[string][]munki.TagHistoryEntry
+}
+
+type tagFile struct {
+	Tags    map[string]*munki.Tag              `json:"tags"`
+	History map[string][]munki.TagHistoryEntry `json:"history"`
+}
+
+// NewFileTagStore loads path if it exists, or starts empty if it doesn't.
+func NewFileTagStore(path string, manifests munki.ManifestStore) (*FileTagStore, error) {
+	s := &FileTagStore{
+		path:      path,
+		manifests: manifests,
+		tags:      make(map[string]*munki.Tag),
+		history:   make(map[string][]munki.TagHistoryEntry),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileTagStore) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f tagFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.Tags != nil {
+		s.tags = f.Tags
+	}
+	if f.History != nil {
+		s.history = f.History
+	}
+	return nil
+}
+
+// persist writes the current tags and history to disk. Callers must hold s.mu.
+func (s *FileTagStore) persist() error {
+	data, err := json.Marshal(tagFile{Tags: s.tags, History: s.history})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.path, data)
+}
+
+// wouldCycle reports whether repointing name at target would make name
+// resolve back into its own chain by following target's existing tag
+// chain. Callers must hold s.mu.
+func (s *FileTagStore) wouldCycle(name, target string) bool {
+	seen := map[string]bool{name: true}
+	for {
+		if seen[target] {
+			return true
+		}
+		seen[target] = true
+		next, ok := s.tags[target]
+		if !ok {
+			return false
+		}
+		target = next.Target
+	}
+}
+
+func (s *FileTagStore) Tag(name string) (*munki.Tag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tag, ok := s.tags[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return tag, nil
+}
+
+// SaveTag atomically repoints name at target, recording the previous
+// target (if any) in the tag's history so it can be rolled back to. It
+// rejects a target that would make name resolve back into its own chain
+// (including name == target), since ShowManifest follows tag chains and a
+// tag on a cycle can never resolve to a manifest.
+func (s *FileTagStore) SaveTag(name string, target string) (*munki.Tag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wouldCycle(name, target) {
+		return nil, ErrTagCycle
+	}
+
+	if prev, ok := s.tags[name]; ok {
+		s.history[name] = append(s.history[name], munki.TagHistoryEntry{
+			Target: prev.Target,
+			SetAt:  prev.UpdateAt,
+		})
+	}
+	tag := &munki.Tag{Name: name, Target: target, UpdateAt: time.Now()}
+	s.tags[name] = tag
+	if err := s.persist(); err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+func (s *FileTagStore) DeleteTag(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tags[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.tags, name)
+	delete(s.history, name)
+	return s.persist()
+}
+
+func (s *FileTagStore) TagHistory(name string) ([]munki.TagHistoryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tags[name]; !ok {
+		return nil, ErrNotFound
+	}
+	return s.history[name], nil
+}
+
+// ManifestByDigest scans every stored manifest for one whose content
+// digest matches. A store backing large manifest counts should maintain a
+// digest index instead; this is the reference implementation.
+func (s *FileTagStore) ManifestByDigest(digest string) (munki.Manifest, error) {
+	all, err := s.manifests.AllManifests()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range *all {
+		d, err := munki.Digest(m)
+		if err != nil {
+			return nil, err
+		}
+		if d == digest {
+			return m, nil
+		}
+	}
+	return nil, ErrNotFound
+}
@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/micromdm/squirrel/munki/munki"
+)
+
+// fakeManifestStore is the minimal munki.ManifestStore needed to exercise
+// FileTagStore.ManifestByDigest.
+type fakeManifestStore struct {
+	all munki.ManifestCollection
+}
+
+func (f *fakeManifestStore) AllManifests() (*munki.ManifestCollection, error) { return &f.all, nil }
+func (f *fakeManifestStore) Manifest(name string) (munki.Manifest, error)     { return nil, ErrNotFound }
+func (f *fakeManifestStore) NewManifest(name string) (munki.Manifest, error)  { return nil, ErrNotFound }
+func (f *fakeManifestStore) SaveManifest(path string, m munki.Manifest) error { return nil }
+func (f *fakeManifestStore) DeleteManifest(name string) error                 { return nil }
+func (f *fakeManifestStore) ManifestDigest(name string) (string, error)       { return "", ErrNotFound }
+
+func TestFileTagStoreSaveAndHistory(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileTagStore(filepath.Join(dir, "tags.json"), &fakeManifestStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.SaveTag("production", "site-a-v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SaveTag("production", "site-a-v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := store.Tag("production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Target != "site-a-v2" {
+		t.Errorf("Target = %q, want %q", tag.Target, "site-a-v2")
+	}
+
+	history, err := store.TagHistory("production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Target != "site-a-v1" {
+		t.Errorf("history = %+v, want one entry pointing at site-a-v1", history)
+	}
+
+	if err := store.DeleteTag("production"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Tag("production"); err != ErrNotFound {
+		t.Errorf("Tag() after delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestFileTagStoreSaveTagRejectsCycles(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileTagStore(filepath.Join(dir, "tags.json"), &fakeManifestStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.SaveTag("a", "a"); err != ErrTagCycle {
+		t.Errorf("SaveTag(a, a) = %v, want ErrTagCycle", err)
+	}
+
+	if _, err := store.SaveTag("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SaveTag("b", "a"); err != ErrTagCycle {
+		t.Errorf("SaveTag(b, a) with a->b already set = %v, want ErrTagCycle", err)
+	}
+
+	// b still resolves to its pre-rejection state: no tag, not a's target.
+	if _, err := store.Tag("b"); err != ErrNotFound {
+		t.Errorf("Tag(b) after rejected SaveTag = %v, want ErrNotFound", err)
+	}
+}
+
+func TestFileTagStorePersistsAcrossReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.json")
+	store, err := NewFileTagStore(path, &fakeManifestStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SaveTag("lab-test", "site-b-v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewFileTagStore(path, &fakeManifestStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := reloaded.Tag("lab-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Target != "site-b-v1" {
+		t.Errorf("Target = %q, want %q", tag.Target, "site-b-v1")
+	}
+}
@@ -0,0 +1,26 @@
+package munki
+
+// CatalogStore is the interface for reading and writing munki catalogs --
+// the per-catalog-name indexes of pkgsinfo that munki clients fetch
+// instead of scanning every pkginfo individually.
+type CatalogStore interface {
+	// Catalog returns the pkgsinfos currently indexed under name. It
+	// returns an error satisfying the store's own not-found convention
+	// when the catalog has never been written.
+	Catalog(name string) ([]*Pkgsinfo, error)
+	// SaveCatalog replaces the catalog named name with items wholesale. A
+	// nil or empty items empties the catalog rather than removing it.
+	SaveCatalog(name string, items []*Pkgsinfo) error
+	// AllCatalogNames lists every catalog the store currently knows
+	// about, including ones that are empty.
+	AllCatalogNames() ([]string, error)
+}
+
+// CatalogRebuildSummary reports what RebuildCatalogs changed: how many
+// pkgsinfo entries were newly indexed or dropped from a catalog, and which
+// pkgsinfos could not be indexed at all.
+type CatalogRebuildSummary struct {
+	Added   int      `json:"added"`
+	Removed int      `json:"removed"`
+	Errored []string `json:"errored,omitempty"`
+}
@@ -1,17 +1,93 @@
 package munki
 
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/groob/plist"
+)
+
+// Manifest is implemented by every registered manifest schema. Payload
+// returns the canonical media type and serialized bytes for the manifest,
+// so the transport layer can write a response without knowing the concrete
+// schema, and Digest can hash it consistently.
+type Manifest interface {
+	Payload() (mediaType string, bytes []byte, err error)
+}
+
 // ManifestStore is the interface for accessing manifests in a database or filesystem
 type ManifestStore interface {
 	AllManifests() (*ManifestCollection, error)
-	Manifest(name string) (*Manifest, error)
-	NewManifest(name string) (*Manifest, error)
-	SaveManifest(path string, manifest *Manifest) error
+	Manifest(name string) (Manifest, error)
+	NewManifest(name string) (Manifest, error)
+	SaveManifest(path string, manifest Manifest) error
 	DeleteManifest(name string) error
+
+	// ManifestDigest returns the content digest for a stored manifest
+	// without requiring a full read, so stores that persist the digest
+	// alongside the manifest (rather than recomputing it) can serve it
+	// cheaply for conditional requests.
+	ManifestDigest(name string) (string, error)
+}
+
+var schemas = struct {
+	sync.RWMutex
+	byMediaType map[string]func([]byte) (Manifest, error)
+}{byMediaType: make(map[string]func([]byte) (Manifest, error))}
+
+// RegisterManifestSchema makes an unmarshal function available under
+// mediaType for decodeCreateManifestRequest / decodeReplaceManifestRequest
+// to pick up by Content-Type. It panics on a duplicate registration for the
+// same media type, following the same convention as database/sql drivers.
+func RegisterManifestSchema(mediaType string, unmarshal func([]byte) (Manifest, error)) {
+	schemas.Lock()
+	defer schemas.Unlock()
+	if _, dup := schemas.byMediaType[mediaType]; dup {
+		panic("munki: RegisterManifestSchema called twice for media type " + mediaType)
+	}
+	schemas.byMediaType[mediaType] = unmarshal
+}
+
+// UnmarshalManifest decodes data into the Manifest schema registered for
+// mediaType.
+func UnmarshalManifest(mediaType string, data []byte) (Manifest, error) {
+	schemas.RLock()
+	unmarshal, ok := schemas.byMediaType[mediaType]
+	schemas.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("munki: no manifest schema registered for media type %q", mediaType)
+	}
+	return unmarshal(data)
 }
 
-// Manifest represents the structure of a munki manifest
-// This is what would be serialized in a datastore
-type Manifest struct {
+func init() {
+	unmarshalV1 := func(data []byte) (Manifest, error) {
+		var m ManifestV1
+		if err := plist.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}
+	unmarshalV1JSON := func(data []byte) (Manifest, error) {
+		var m ManifestV1
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}
+	RegisterManifestSchema("application/x-apple-plist", unmarshalV1)
+	RegisterManifestSchema("application/json", unmarshalV1JSON)
+}
+
+// ManifestV1 is the default manifest schema: the structure munki itself
+// reads and writes. It is registered for "application/x-apple-plist" and
+// "application/json", and is what every endpoint in this package produced
+// before ManifestStore learned to serve other schemas.
+type ManifestV1 struct {
 	Filename          string      `plist:"-" json:"-"`
 	Catalogs          []string    `plist:"catalogs,omitempty" json:"catalogs,omitempty"`
 	DisplayName       string      `plist:"display_name,omitempty" json:"display_name,omitempty"`
@@ -35,10 +111,26 @@ type condition struct {
 }
 
 // ManifestCollection represents a list of manifests
-type ManifestCollection []*Manifest
+type ManifestCollection []Manifest
+
+// ManifestPayload is the set of ManifestV1 fields accepted from a create or
+// update request body. A nil field is left unchanged by UpdateFromPayload,
+// distinguishing "not provided" from "explicitly cleared".
+type ManifestPayload struct {
+	Catalogs          *[]string    `json:"catalogs,omitempty"`
+	DisplayName       *string      `json:"display_name,omitempty"`
+	IncludedManifests *[]string    `json:"included_manifests,omitempty"`
+	Notes             *string      `json:"notes,omitempty"`
+	User              *string      `json:"user,omitempty"`
+	ConditionalItems  *[]condition `json:"conditional_items,omitempty"`
+	OptionalInstalls  *[]string    `json:"optional_installs,omitempty"`
+	ManagedInstalls   *[]string    `json:"managed_installs,omitempty"`
+	ManagedUninstalls *[]string    `json:"managed_uninstalls,omitempty"`
+	ManagedUpdates    *[]string    `json:"managed_updates,omitempty"`
+}
 
 // UpdateFromPayload updates a manifest from a ManifestPayload
-func (m *Manifest) UpdateFromPayload(payload *ManifestPayload) {
+func (m *ManifestV1) UpdateFromPayload(payload *ManifestPayload) {
 	if payload.Catalogs != nil {
 		m.Catalogs = *payload.Catalogs
 	}
@@ -79,3 +171,27 @@ func (m *Manifest) UpdateFromPayload(payload *ManifestPayload) {
 		m.ConditionalItems = *payload.ConditionalItems
 	}
 }
+
+// Payload implements Manifest. ManifestV1 always serializes to its native
+// plist form, regardless of whether it was decoded from plist or JSON.
+func (m *ManifestV1) Payload() (string, []byte, error) {
+	var buf bytes.Buffer
+	enc := plist.NewEncoder(&buf)
+	if err := enc.Encode(m); err != nil {
+		return "", nil, err
+	}
+	return "application/x-apple-plist", buf.Bytes(), nil
+}
+
+// Digest returns a content digest of a manifest's Payload, in the
+// "sha256:<hex>" form used for the Content-Digest and ETag headers. Stores
+// may cache this instead of recomputing it on every read, but the result
+// must always match what this function would produce.
+func Digest(m Manifest) (string, error) {
+	_, data, err := m.Payload()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
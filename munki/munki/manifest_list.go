@@ -0,0 +1,56 @@
+package munki
+
+import (
+	"bytes"
+
+	"github.com/groob/plist"
+)
+
+// ManifestListMediaType identifies the manifest-list schema: a composite
+// manifest that references its children by content digest instead of
+// embedding them.
+const ManifestListMediaType = "application/vnd.munki.manifest.list+plist"
+
+// ManifestList is a Manifest implementation that names a set of child
+// manifests by digest rather than by filename, e.g. so a client's
+// ManifestURL can pin to exact, immutable content for every included
+// manifest at once.
+type ManifestList struct {
+	Filename  string   `plist:"-" json:"-"`
+	Manifests []string `plist:"manifests" json:"manifests"`
+}
+
+// Payload implements Manifest.
+func (l *ManifestList) Payload() (string, []byte, error) {
+	var buf bytes.Buffer
+	enc := plist.NewEncoder(&buf)
+	if err := enc.Encode(l); err != nil {
+		return "", nil, err
+	}
+	return ManifestListMediaType, buf.Bytes(), nil
+}
+
+// Resolve looks up every digest referenced by the list in store and
+// returns a ManifestV1 whose IncludedManifests names them, which is how a
+// client that only understands munkiv1 can still consume a manifest list:
+// the server resolves it for them on fetch.
+func (l *ManifestList) Resolve(store TagStore) (*ManifestV1, error) {
+	resolved := &ManifestV1{Filename: l.Filename}
+	for _, digest := range l.Manifests {
+		if _, err := store.ManifestByDigest(digest); err != nil {
+			return nil, err
+		}
+		resolved.IncludedManifests = append(resolved.IncludedManifests, digest)
+	}
+	return resolved, nil
+}
+
+func init() {
+	RegisterManifestSchema(ManifestListMediaType, func(data []byte) (Manifest, error) {
+		var l ManifestList
+		if err := plist.Unmarshal(data, &l); err != nil {
+			return nil, err
+		}
+		return &l, nil
+	})
+}
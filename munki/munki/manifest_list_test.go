@@ -0,0 +1,50 @@
+package munki
+
+import "testing"
+
+type fakeDigestTagStore struct {
+	byDigest map[string]Manifest
+}
+
+func (f *fakeDigestTagStore) Tag(name string) (*Tag, error)                     { return nil, nil }
+func (f *fakeDigestTagStore) SaveTag(name, target string) (*Tag, error)         { return nil, nil }
+func (f *fakeDigestTagStore) DeleteTag(name string) error                       { return nil }
+func (f *fakeDigestTagStore) TagHistory(name string) ([]TagHistoryEntry, error) { return nil, nil }
+func (f *fakeDigestTagStore) ManifestByDigest(digest string) (Manifest, error) {
+	m, ok := f.byDigest[digest]
+	if !ok {
+		return nil, errNotFoundForTest{}
+	}
+	return m, nil
+}
+
+type errNotFoundForTest struct{}
+
+func (errNotFoundForTest) Error() string { return "not found" }
+
+func TestManifestListResolve(t *testing.T) {
+	store := &fakeDigestTagStore{byDigest: map[string]Manifest{
+		"sha256:aaa": &ManifestV1{Filename: "base"},
+	}}
+	list := &ManifestList{Filename: "site-a", Manifests: []string{"sha256:aaa"}}
+
+	resolved, err := list.Resolve(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Filename != "site-a" {
+		t.Errorf("Filename = %q, want %q", resolved.Filename, "site-a")
+	}
+	if len(resolved.IncludedManifests) != 1 || resolved.IncludedManifests[0] != "sha256:aaa" {
+		t.Errorf("IncludedManifests = %v, want [sha256:aaa]", resolved.IncludedManifests)
+	}
+}
+
+func TestManifestListResolveMissingDigest(t *testing.T) {
+	store := &fakeDigestTagStore{byDigest: map[string]Manifest{}}
+	list := &ManifestList{Filename: "site-a", Manifests: []string{"sha256:missing"}}
+
+	if _, err := list.Resolve(store); err == nil {
+		t.Fatal("expected an error for an unresolvable digest")
+	}
+}
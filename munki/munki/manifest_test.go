@@ -0,0 +1,42 @@
+package munki
+
+import "testing"
+
+func TestUnmarshalManifestDispatchesByMediaType(t *testing.T) {
+	data, err := plistEncode(&ManifestV1{DisplayName: "site-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := UnmarshalManifest("application/x-apple-plist", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, ok := m.(*ManifestV1)
+	if !ok {
+		t.Fatalf("UnmarshalManifest returned %T, want *ManifestV1", m)
+	}
+	if v1.DisplayName != "site-a" {
+		t.Errorf("DisplayName = %q, want %q", v1.DisplayName, "site-a")
+	}
+}
+
+func TestUnmarshalManifestUnknownMediaType(t *testing.T) {
+	if _, err := UnmarshalManifest("application/does-not-exist", nil); err == nil {
+		t.Fatal("expected an error for an unregistered media type")
+	}
+}
+
+func TestRegisterManifestSchemaPanicsOnDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic registering a duplicate media type")
+		}
+	}()
+	RegisterManifestSchema("application/x-apple-plist", func([]byte) (Manifest, error) { return nil, nil })
+}
+
+func plistEncode(m *ManifestV1) ([]byte, error) {
+	_, data, err := m.Payload()
+	return data, err
+}
@@ -0,0 +1,92 @@
+package munki
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/groob/plist"
+)
+
+// Pkgsinfo represents the subset of a munki pkginfo that squirrel manages
+// directly. Like Manifest, this is what would be serialized in a datastore.
+type Pkgsinfo struct {
+	Filename              string   `plist:"-" json:"-"`
+	Name                  string   `plist:"name" json:"name"`
+	Version               string   `plist:"version" json:"version"`
+	Catalogs              []string `plist:"catalogs,omitempty" json:"catalogs,omitempty"`
+	DisplayName           string   `plist:"display_name,omitempty" json:"display_name,omitempty"`
+	Description           string   `plist:"description,omitempty" json:"description,omitempty"`
+	InstallerItemLocation string   `plist:"installer_item_location,omitempty" json:"installer_item_location,omitempty"`
+}
+
+// PkgsinfoPayload is the set of Pkgsinfo fields accepted from a create or
+// update request body. A nil field is left unchanged by UpdateFromPayload.
+type PkgsinfoPayload struct {
+	Name                  *string   `json:"name,omitempty"`
+	Version               *string   `json:"version,omitempty"`
+	Catalogs              *[]string `json:"catalogs,omitempty"`
+	DisplayName           *string   `json:"display_name,omitempty"`
+	Description           *string   `json:"description,omitempty"`
+	InstallerItemLocation *string   `json:"installer_item_location,omitempty"`
+}
+
+// UpdateFromPayload updates a pkgsinfo from a PkgsinfoPayload.
+func (p *Pkgsinfo) UpdateFromPayload(payload *PkgsinfoPayload) {
+	if payload.Name != nil {
+		p.Name = *payload.Name
+	}
+	if payload.Version != nil {
+		p.Version = *payload.Version
+	}
+	if payload.Catalogs != nil {
+		p.Catalogs = *payload.Catalogs
+	}
+	if payload.DisplayName != nil {
+		p.DisplayName = *payload.DisplayName
+	}
+	if payload.Description != nil {
+		p.Description = *payload.Description
+	}
+	if payload.InstallerItemLocation != nil {
+		p.InstallerItemLocation = *payload.InstallerItemLocation
+	}
+}
+
+// Payload serializes p to its native plist form, the same convention
+// Manifest.Payload uses, so it can be hashed into a digest the same way.
+func (p *Pkgsinfo) Payload() (string, []byte, error) {
+	var buf bytes.Buffer
+	enc := plist.NewEncoder(&buf)
+	if err := enc.Encode(p); err != nil {
+		return "", nil, err
+	}
+	return "application/x-apple-plist", buf.Bytes(), nil
+}
+
+// Digest returns p's content digest in the same "sha256:<hex>" form used
+// for manifests, so pkgsinfo mutations can use the same If-Match scheme.
+func (p *Pkgsinfo) Digest() (string, error) {
+	_, data, err := p.Payload()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// PkgsinfoCollection represents a list of pkgsinfos.
+type PkgsinfoCollection []*Pkgsinfo
+
+// PkgsinfoStore is the interface for accessing pkgsinfos in a database or filesystem
+type PkgsinfoStore interface {
+	AllPkgsinfos() (*PkgsinfoCollection, error)
+	Pkgsinfo(name string) (*Pkgsinfo, error)
+	NewPkgsinfo(name string) (*Pkgsinfo, error)
+	SavePkgsinfo(path string, info *Pkgsinfo) error
+	DeletePkgsinfo(name string) error
+
+	// PkgsinfoDigest mirrors ManifestStore.ManifestDigest: it lets a store
+	// that persists the digest serve it without a full read.
+	PkgsinfoDigest(name string) (string, error)
+}
@@ -0,0 +1,34 @@
+package munki
+
+import "time"
+
+// Tag maps a human-readable reference (e.g. "production", "lab-test",
+// "v2024.03") to a concrete manifest identity, either a filename or a
+// content digest. Clients can be pointed at a stable URL built from Name
+// while an operator atomically repoints Target to roll a new manifest out
+// or back.
+type Tag struct {
+	Name     string    `json:"name"`
+	Target   string    `json:"target"`
+	UpdateAt time.Time `json:"updated_at"`
+}
+
+// TagHistoryEntry records a previous Target a tag pointed at, so operators
+// can see what a tag used to resolve to and roll back to it.
+type TagHistoryEntry struct {
+	Target string    `json:"target"`
+	SetAt  time.Time `json:"set_at"`
+}
+
+// TagStore persists tag -> manifest target mappings, alongside the history
+// of targets a tag has previously pointed to.
+type TagStore interface {
+	Tag(name string) (*Tag, error)
+	SaveTag(name string, target string) (*Tag, error)
+	DeleteTag(name string) error
+	TagHistory(name string) ([]TagHistoryEntry, error)
+
+	// ManifestByDigest resolves a content digest directly to a manifest,
+	// independent of any tag or filename.
+	ManifestByDigest(digest string) (Manifest, error)
+}
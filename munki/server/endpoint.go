@@ -0,0 +1,370 @@
+package munkiserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/gorilla/mux"
+	"github.com/micromdm/squirrel/munki/munki"
+	"golang.org/x/net/context"
+)
+
+// manifestResponse wraps a manifest with its digest so encodeResponse can
+// both serialize it (Payload, promoted from munki.Manifest, satisfies
+// munki.Manifest) and emit Content-Digest/ETag headers (headers, satisfies
+// headerer).
+type manifestResponse struct {
+	munki.Manifest
+	digest     string
+	httpStatus int
+	err        error
+}
+
+func (r manifestResponse) error() error { return r.err }
+
+func (r manifestResponse) status() int {
+	if r.httpStatus == 0 {
+		return http.StatusOK
+	}
+	return r.httpStatus
+}
+
+func (r manifestResponse) headers() map[string]string {
+	if r.digest == "" {
+		return nil
+	}
+	return map[string]string{
+		"Content-Digest": r.digest,
+		"ETag":           r.digest,
+	}
+}
+
+// manifestCollectionResponse unwraps to its ManifestCollection for
+// encodeResponse's subsetEncoder handling, so the wire format is a bare
+// list rather than {"Manifests": [...], "err": null}.
+type manifestCollectionResponse struct {
+	Manifests munki.ManifestCollection
+	err       error
+}
+
+func (r manifestCollectionResponse) error() error        { return r.err }
+func (r manifestCollectionResponse) subset() interface{} { return r.Manifests }
+
+// statusResponse is a bodyless response that only carries a status code and
+// an optional error, for DELETE-style endpoints.
+type statusResponse struct {
+	httpStatus int
+	err        error
+}
+
+func (r statusResponse) error() error { return r.err }
+func (r statusResponse) status() int  { return r.httpStatus }
+
+func pathVar(r *http.Request) (string, error) {
+	path, ok := mux.Vars(r)["path"]
+	if !ok {
+		return "", errBadRouting
+	}
+	return path, nil
+}
+
+// checkManifestPrecondition enforces If-Match/If-None-Match on a manifest
+// mutation by comparing against the manifest's current digest. A request
+// with neither header always proceeds.
+func checkManifestPrecondition(svc Service, r *http.Request, path string) error {
+	if r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "" {
+		return nil
+	}
+	digest, err := svc.ManifestDigest(path)
+	if err != nil {
+		return err
+	}
+	return checkPrecondition(r, digest)
+}
+
+// requestContentType returns r's Content-Type with any parameters (e.g.
+// "; charset=utf-8") stripped, defaulting to "application/json" when the
+// header is absent, so a client that doesn't set it still gets the
+// munkiv1 schema rather than a rejected request.
+func requestContentType(r *http.Request) string {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return "application/json"
+	}
+	if i := strings.IndexByte(ct, ';'); i != -1 {
+		ct = ct[:i]
+	}
+	return strings.TrimSpace(ct)
+}
+
+// decodeManifestBody reads r's body and unmarshals it via the schema
+// registered for its Content-Type, so POST/PUT can accept any manifest
+// schema munki.RegisterManifestSchema knows about, not just munkiv1.
+func decodeManifestBody(r *http.Request) (munki.Manifest, error) {
+	if r.Body == nil {
+		return nil, errEmptyRequest
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errEmptyRequest
+	}
+	return munki.UnmarshalManifest(requestContentType(r), data)
+}
+
+// --- list manifests ---
+
+type listManifestsRequest struct{}
+
+func decodeListManifestsRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	return listManifestsRequest{}, nil
+}
+
+func makeListManifestsEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		manifests, err := svc.ListManifests()
+		if err != nil {
+			return manifestCollectionResponse{err: err}, nil
+		}
+		return manifestCollectionResponse{Manifests: *manifests}, nil
+	}
+}
+
+// --- show manifest ---
+
+type showManifestRequest struct {
+	Path string
+}
+
+func decodeShowManifestRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	path, err := pathVar(r)
+	if err != nil {
+		return nil, err
+	}
+	return showManifestRequest{Path: path}, nil
+}
+
+func makeShowManifestEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(showManifestRequest)
+		m, err := svc.ShowManifest(req.Path)
+		if err != nil {
+			return manifestResponse{err: err}, nil
+		}
+		digest, err := munki.Digest(m)
+		if err != nil {
+			return manifestResponse{err: err}, nil
+		}
+		return manifestResponse{Manifest: m, digest: digest}, nil
+	}
+}
+
+// --- create manifest ---
+
+// createManifestRequest holds either a Payload (the client POSTed
+// "application/json" with a {"name": ..., ...fields} envelope, the
+// original munkiv1-only shape) or a Manifest (the client POSTed a body in
+// some other schema munki.RegisterManifestSchema knows about, addressed
+// by Content-Type, with the name passed as a query parameter instead).
+type createManifestRequest struct {
+	Name     string
+	Payload  *munki.ManifestPayload
+	Manifest munki.Manifest
+}
+
+func decodeCreateManifestRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	if r.Body == nil {
+		return nil, errEmptyRequest
+	}
+	if requestContentType(r) == "application/json" {
+		var req struct {
+			Name string `json:"name"`
+			munki.ManifestPayload
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, err
+		}
+		if req.Name == "" {
+			return nil, errEmptyRequest
+		}
+		return createManifestRequest{Name: req.Name, Payload: &req.ManifestPayload}, nil
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return nil, errEmptyRequest
+	}
+	m, err := decodeManifestBody(r)
+	if err != nil {
+		return nil, err
+	}
+	return createManifestRequest{Name: name, Manifest: m}, nil
+}
+
+func makeCreateManifestEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(createManifestRequest)
+		var (
+			m   munki.Manifest
+			err error
+		)
+		if req.Payload != nil {
+			m, err = svc.CreateManifest(req.Name, req.Payload)
+		} else {
+			m, err = svc.CreateManifestFromSchema(req.Name, req.Manifest)
+		}
+		if err != nil {
+			return manifestResponse{err: err}, nil
+		}
+		digest, err := munki.Digest(m)
+		if err != nil {
+			return manifestResponse{err: err}, nil
+		}
+		return manifestResponse{Manifest: m, digest: digest, httpStatus: http.StatusCreated}, nil
+	}
+}
+
+// --- replace manifest ---
+
+type replaceManifestRequest struct {
+	Path     string
+	Manifest munki.Manifest
+}
+
+// decodeReplaceManifestRequest is curried over svc so it can look up the
+// manifest's current digest and enforce If-Match/If-None-Match before the
+// endpoint (and thus the store) is ever invoked. The body is decoded via
+// the schema registered for its Content-Type, so PUT can replace a
+// manifest with any registered schema, not just munkiv1.
+func decodeReplaceManifestRequest(svc Service) func(context.Context, *http.Request) (interface{}, error) {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		path, err := pathVar(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkManifestPrecondition(svc, r, path); err != nil {
+			return nil, err
+		}
+		m, err := decodeManifestBody(r)
+		if err != nil {
+			return nil, err
+		}
+		return replaceManifestRequest{Path: path, Manifest: m}, nil
+	}
+}
+
+func makeReplaceManifestEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(replaceManifestRequest)
+		m, err := svc.ReplaceManifest(req.Path, req.Manifest)
+		if err != nil {
+			return manifestResponse{err: err}, nil
+		}
+		digest, err := munki.Digest(m)
+		if err != nil {
+			return manifestResponse{err: err}, nil
+		}
+		return manifestResponse{Manifest: m, digest: digest}, nil
+	}
+}
+
+// --- update (patch) manifest ---
+
+// updateManifestRequest holds either a Payload (a partial
+// "application/json" body, merged field-by-field into the existing
+// manifest -- only defined for the mutable munkiv1 schema) or a Manifest
+// (a full body in some other registered schema, which replaces the
+// resource wholesale the same as PUT, since partial field merging isn't
+// meaningful for a schema the server doesn't know the fields of).
+type updateManifestRequest struct {
+	Path     string
+	Payload  *munki.ManifestPayload
+	Manifest munki.Manifest
+}
+
+func decodeUpdateManifestRequest(svc Service) func(context.Context, *http.Request) (interface{}, error) {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		path, err := pathVar(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkManifestPrecondition(svc, r, path); err != nil {
+			return nil, err
+		}
+		if r.Body == nil {
+			return nil, errEmptyRequest
+		}
+		if requestContentType(r) != "application/json" {
+			m, err := decodeManifestBody(r)
+			if err != nil {
+				return nil, err
+			}
+			return updateManifestRequest{Path: path, Manifest: m}, nil
+		}
+		var payload munki.ManifestPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			return nil, err
+		}
+		return updateManifestRequest{Path: path, Payload: &payload}, nil
+	}
+}
+
+func makeUpdateManifestEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(updateManifestRequest)
+		var (
+			m   munki.Manifest
+			err error
+		)
+		if req.Payload != nil {
+			m, err = svc.UpdateManifest(req.Path, req.Payload)
+		} else {
+			// a full, non-JSON body on PATCH has no partial-merge
+			// semantics to fall back on, so it replaces the resource
+			// wholesale, same as PUT.
+			m, err = svc.ReplaceManifest(req.Path, req.Manifest)
+		}
+		if err != nil {
+			return manifestResponse{err: err}, nil
+		}
+		digest, err := munki.Digest(m)
+		if err != nil {
+			return manifestResponse{err: err}, nil
+		}
+		return manifestResponse{Manifest: m, digest: digest}, nil
+	}
+}
+
+// --- delete manifest ---
+
+type deleteManifestRequest struct {
+	Path string
+}
+
+func decodeDeleteManifestRequest(svc Service) func(context.Context, *http.Request) (interface{}, error) {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		path, err := pathVar(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkManifestPrecondition(svc, r, path); err != nil {
+			return nil, err
+		}
+		return deleteManifestRequest{Path: path}, nil
+	}
+}
+
+func makeDeleteManifestEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(deleteManifestRequest)
+		if err := svc.DeleteManifest(req.Path); err != nil {
+			return statusResponse{err: err}, nil
+		}
+		return statusResponse{httpStatus: http.StatusNoContent}, nil
+	}
+}
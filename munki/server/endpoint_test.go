@@ -0,0 +1,104 @@
+package munkiserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/micromdm/squirrel/munki/munki"
+)
+
+func TestRequestContentType(t *testing.T) {
+	cases := []struct {
+		header string
+		want   string
+	}{
+		{"", "application/json"},
+		{"application/json", "application/json"},
+		{"application/json; charset=utf-8", "application/json"},
+		{munki.ManifestListMediaType, munki.ManifestListMediaType},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPut, "/api/v1/manifests/site-a", nil)
+		if c.header != "" {
+			r.Header.Set("Content-Type", c.header)
+		}
+		if got := requestContentType(r); got != c.want {
+			t.Errorf("requestContentType(%q) = %q, want %q", c.header, got, c.want)
+		}
+	}
+}
+
+// TestDecodeReplaceManifestRequestDispatchesByContentType confirms a PUT
+// whose Content-Type names a non-default schema is decoded via that
+// schema's registered unmarshaller, not forced through the munkiv1
+// ManifestPayload shape.
+func TestDecodeReplaceManifestRequestDispatchesByContentType(t *testing.T) {
+	list := &munki.ManifestList{Filename: "site-a", Manifests: []string{"sha256:aaa"}}
+	_, body, err := list.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPut, "/api/v1/manifests/site-a", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", munki.ManifestListMediaType)
+	r = mux.SetURLVars(r, map[string]string{"path": "site-a"})
+
+	decode := decodeReplaceManifestRequest(&fakeManifestOnlyService{})
+	req, err := decode(nil, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaceReq, ok := req.(replaceManifestRequest)
+	if !ok {
+		t.Fatalf("decode returned %T, want replaceManifestRequest", req)
+	}
+	decoded, ok := replaceReq.Manifest.(*munki.ManifestList)
+	if !ok {
+		t.Fatalf("Manifest = %T, want *munki.ManifestList", replaceReq.Manifest)
+	}
+	if replaceReq.Path != "site-a" || len(decoded.Manifests) != 1 || decoded.Manifests[0] != "sha256:aaa" {
+		t.Errorf("decoded = %+v, want a ManifestList pointing at site-a/sha256:aaa", decoded)
+	}
+}
+
+// TestDecodeCreateManifestRequestNonJSONSchema confirms a POST with a
+// non-default Content-Type is decoded via the schema registry, with the
+// name taken from the query string instead of a JSON envelope field.
+func TestDecodeCreateManifestRequestNonJSONSchema(t *testing.T) {
+	list := &munki.ManifestList{Manifests: []string{"sha256:bbb"}}
+	_, body, err := list.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/manifests?name=site-b", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", munki.ManifestListMediaType)
+
+	req, err := decodeCreateManifestRequest(nil, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createReq, ok := req.(createManifestRequest)
+	if !ok {
+		t.Fatalf("decode returned %T, want createManifestRequest", req)
+	}
+	if createReq.Name != "site-b" {
+		t.Errorf("Name = %q, want %q", createReq.Name, "site-b")
+	}
+	if createReq.Payload != nil {
+		t.Error("Payload should be nil for a non-JSON schema create")
+	}
+	if _, ok := createReq.Manifest.(*munki.ManifestList); !ok {
+		t.Fatalf("Manifest = %T, want *munki.ManifestList", createReq.Manifest)
+	}
+}
+
+// fakeManifestOnlyService is a Service whose only method exercised by
+// these decode tests, ManifestDigest, is never reached because the
+// requests carry no If-Match/If-None-Match header.
+type fakeManifestOnlyService struct {
+	Service
+}
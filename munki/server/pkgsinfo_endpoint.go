@@ -0,0 +1,302 @@
+package munkiserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/micromdm/squirrel/munki/munki"
+	"golang.org/x/net/context"
+)
+
+// pkgsinfoResponse wraps a pkgsinfo with its digest so encodeResponse can
+// emit Content-Digest/ETag headers via headerer. Unlike manifestResponse,
+// Pkgsinfo is a named field rather than embedded: Pkgsinfo.Payload() has
+// the same signature as munki.Manifest.Payload(), so embedding it would
+// make pkgsinfoResponse satisfy munki.Manifest by promotion and send
+// encodeResponse's plist-writing branch raw plist bytes under a JSON
+// Content-Type. subset() unwraps to Pkgsinfo for encodeResponse instead.
+type pkgsinfoResponse struct {
+	Pkgsinfo   *munki.Pkgsinfo
+	digest     string
+	httpStatus int
+	err        error
+}
+
+func (r pkgsinfoResponse) error() error        { return r.err }
+func (r pkgsinfoResponse) subset() interface{} { return r.Pkgsinfo }
+
+func (r pkgsinfoResponse) status() int {
+	if r.httpStatus == 0 {
+		return http.StatusOK
+	}
+	return r.httpStatus
+}
+
+func (r pkgsinfoResponse) headers() map[string]string {
+	if r.digest == "" {
+		return nil
+	}
+	return map[string]string{
+		"Content-Digest": r.digest,
+		"ETag":           r.digest,
+	}
+}
+
+// pkgsinfoCollectionResponse unwraps to its Pkgsinfos for encodeResponse's
+// subsetEncoder handling, so the wire format is a bare list.
+type pkgsinfoCollectionResponse struct {
+	Pkgsinfos munki.PkgsinfoCollection
+	err       error
+}
+
+func (r pkgsinfoCollectionResponse) error() error        { return r.err }
+func (r pkgsinfoCollectionResponse) subset() interface{} { return r.Pkgsinfos }
+
+// catalogRebuildResponse reports a CatalogRebuildSummary as the response
+// body, with no digest/headers of its own.
+type catalogRebuildResponse struct {
+	*munki.CatalogRebuildSummary
+	err error
+}
+
+func (r catalogRebuildResponse) error() error { return r.err }
+
+// checkPkgsinfoPrecondition enforces If-Match/If-None-Match on a pkgsinfo
+// mutation against the pkgsinfo's current digest, the same convention
+// checkManifestPrecondition uses for manifests. A request with neither
+// header always proceeds.
+func checkPkgsinfoPrecondition(svc Service, r *http.Request, path string) error {
+	if r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "" {
+		return nil
+	}
+	digest, err := svc.PkgsinfoDigest(path)
+	if err != nil {
+		return err
+	}
+	return checkPrecondition(r, digest)
+}
+
+func pkgsinfoDigest(p *munki.Pkgsinfo) (string, error) {
+	return p.Digest()
+}
+
+// --- list pkgsinfos ---
+
+type listPkgsinfosRequest struct{}
+
+func decodeListPkgsinfosRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	return listPkgsinfosRequest{}, nil
+}
+
+func makeListPkgsinfosEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		all, err := svc.ListPkgsinfos()
+		if err != nil {
+			return pkgsinfoCollectionResponse{err: err}, nil
+		}
+		return pkgsinfoCollectionResponse{Pkgsinfos: *all}, nil
+	}
+}
+
+// --- show pkgsinfo ---
+
+type showPkgsinfoRequest struct {
+	Path string
+}
+
+func decodeShowPkgsinfoRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	path, err := pathVar(r)
+	if err != nil {
+		return nil, err
+	}
+	return showPkgsinfoRequest{Path: path}, nil
+}
+
+func makeShowPkgsinfoEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(showPkgsinfoRequest)
+		info, err := svc.ShowPkgsinfo(req.Path)
+		if err != nil {
+			return pkgsinfoResponse{err: err}, nil
+		}
+		digest, err := pkgsinfoDigest(info)
+		if err != nil {
+			return pkgsinfoResponse{err: err}, nil
+		}
+		return pkgsinfoResponse{Pkgsinfo: info, digest: digest}, nil
+	}
+}
+
+// --- create pkgsinfo ---
+
+type createPkgsinfoRequest struct {
+	Name string `json:"name"`
+	munki.PkgsinfoPayload
+}
+
+func decodeCreatePkgsinfoRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	if r.Body == nil {
+		return nil, errEmptyRequest
+	}
+	var req createPkgsinfoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, errEmptyRequest
+	}
+	return req, nil
+}
+
+func makeCreatePkgsinfoEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(createPkgsinfoRequest)
+		info, err := svc.CreatePkgsinfo(req.Name, &req.PkgsinfoPayload)
+		if err != nil {
+			return pkgsinfoResponse{err: err}, nil
+		}
+		digest, err := pkgsinfoDigest(info)
+		if err != nil {
+			return pkgsinfoResponse{err: err}, nil
+		}
+		return pkgsinfoResponse{Pkgsinfo: info, digest: digest, httpStatus: http.StatusCreated}, nil
+	}
+}
+
+// --- replace pkgsinfo ---
+
+type replacePkgsinfoRequest struct {
+	Path string
+	munki.PkgsinfoPayload
+}
+
+// decodeReplacePkgsinfoRequest is curried over svc so it can look up the
+// pkgsinfo's current digest and enforce If-Match/If-None-Match before the
+// endpoint (and thus the store) is ever invoked, same as
+// decodeReplaceManifestRequest.
+func decodeReplacePkgsinfoRequest(svc Service) func(context.Context, *http.Request) (interface{}, error) {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		path, err := pathVar(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPkgsinfoPrecondition(svc, r, path); err != nil {
+			return nil, err
+		}
+		if r.Body == nil {
+			return nil, errEmptyRequest
+		}
+		var req replacePkgsinfoRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, err
+		}
+		req.Path = path
+		return req, nil
+	}
+}
+
+func makeReplacePkgsinfoEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(replacePkgsinfoRequest)
+		info, err := svc.ReplacePkgsinfo(req.Path, &req.PkgsinfoPayload)
+		if err != nil {
+			return pkgsinfoResponse{err: err}, nil
+		}
+		digest, err := pkgsinfoDigest(info)
+		if err != nil {
+			return pkgsinfoResponse{err: err}, nil
+		}
+		return pkgsinfoResponse{Pkgsinfo: info, digest: digest}, nil
+	}
+}
+
+// --- update (patch) pkgsinfo ---
+
+type updatePkgsinfoRequest struct {
+	Path string
+	munki.PkgsinfoPayload
+}
+
+func decodeUpdatePkgsinfoRequest(svc Service) func(context.Context, *http.Request) (interface{}, error) {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		path, err := pathVar(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPkgsinfoPrecondition(svc, r, path); err != nil {
+			return nil, err
+		}
+		if r.Body == nil {
+			return nil, errEmptyRequest
+		}
+		var req updatePkgsinfoRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, err
+		}
+		req.Path = path
+		return req, nil
+	}
+}
+
+func makeUpdatePkgsinfoEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(updatePkgsinfoRequest)
+		info, err := svc.UpdatePkgsinfo(req.Path, &req.PkgsinfoPayload)
+		if err != nil {
+			return pkgsinfoResponse{err: err}, nil
+		}
+		digest, err := pkgsinfoDigest(info)
+		if err != nil {
+			return pkgsinfoResponse{err: err}, nil
+		}
+		return pkgsinfoResponse{Pkgsinfo: info, digest: digest}, nil
+	}
+}
+
+// --- delete pkgsinfo ---
+
+type deletePkgsinfoRequest struct {
+	Path string
+}
+
+func decodeDeletePkgsinfoRequest(svc Service) func(context.Context, *http.Request) (interface{}, error) {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		path, err := pathVar(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPkgsinfoPrecondition(svc, r, path); err != nil {
+			return nil, err
+		}
+		return deletePkgsinfoRequest{Path: path}, nil
+	}
+}
+
+func makeDeletePkgsinfoEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(deletePkgsinfoRequest)
+		if err := svc.DeletePkgsinfo(req.Path); err != nil {
+			return statusResponse{err: err}, nil
+		}
+		return statusResponse{httpStatus: http.StatusNoContent}, nil
+	}
+}
+
+// --- rebuild catalogs ---
+
+type rebuildCatalogsRequest struct{}
+
+func decodeRebuildCatalogsRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	return rebuildCatalogsRequest{}, nil
+}
+
+func makeRebuildCatalogsEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		summary, err := svc.RebuildCatalogs()
+		if err != nil {
+			return catalogRebuildResponse{err: err}, nil
+		}
+		return catalogRebuildResponse{CatalogRebuildSummary: summary}, nil
+	}
+}
@@ -0,0 +1,438 @@
+package munkiserver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/micromdm/squirrel/munki/datastore"
+	"github.com/micromdm/squirrel/munki/munki"
+)
+
+// Service is the munki API surface routed through ServiceHandler.
+type Service interface {
+	ListManifests() (*munki.ManifestCollection, error)
+	ShowManifest(path string) (munki.Manifest, error)
+	ManifestDigest(path string) (string, error)
+	CreateManifest(name string, payload *munki.ManifestPayload) (munki.Manifest, error)
+	// CreateManifestFromSchema creates name from a manifest already
+	// decoded by the schema registry (see munki.UnmarshalManifest), so a
+	// client can create a manifest in any registered schema, not just the
+	// mutable munkiv1 default CreateManifest builds from a ManifestPayload.
+	CreateManifestFromSchema(name string, m munki.Manifest) (munki.Manifest, error)
+	// ReplaceManifest wholesale-replaces path's stored manifest with m.
+	// Unlike UpdateManifest, replacement isn't munkiv1-specific: m can be
+	// any schema registered via munki.RegisterManifestSchema.
+	ReplaceManifest(path string, m munki.Manifest) (munki.Manifest, error)
+	UpdateManifest(path string, payload *munki.ManifestPayload) (munki.Manifest, error)
+	DeleteManifest(path string) error
+
+	ShowTag(name string) (*munki.Tag, error)
+	SaveTag(name, target string) (*munki.Tag, error)
+	DeleteTag(name string) error
+	TagHistory(name string) ([]munki.TagHistoryEntry, error)
+	ShowManifestByDigest(digest string) (munki.Manifest, error)
+
+	ListPkgsinfos() (*munki.PkgsinfoCollection, error)
+	ShowPkgsinfo(path string) (*munki.Pkgsinfo, error)
+	PkgsinfoDigest(path string) (string, error)
+	CreatePkgsinfo(name string, payload *munki.PkgsinfoPayload) (*munki.Pkgsinfo, error)
+	ReplacePkgsinfo(path string, payload *munki.PkgsinfoPayload) (*munki.Pkgsinfo, error)
+	UpdatePkgsinfo(path string, payload *munki.PkgsinfoPayload) (*munki.Pkgsinfo, error)
+	DeletePkgsinfo(path string) error
+	RebuildCatalogs() (*munki.CatalogRebuildSummary, error)
+}
+
+type service struct {
+	manifests munki.ManifestStore
+	tags      munki.TagStore
+	pkgsinfos munki.PkgsinfoStore
+	catalogs  munki.CatalogStore
+	logger    kitlog.Logger
+
+	// rebuildMu serializes RebuildCatalogs calls so two overlapping
+	// requests can't interleave writes to the same catalog file.
+	rebuildMu sync.Mutex
+}
+
+// NewService returns a Service backed by manifests, tags, pkgsinfos, and
+// catalogs. tags, pkgsinfos, and catalogs may each be nil, in which case
+// the functionality they back is unavailable: tag/digest addressing on
+// manifest {path} requires tags, and the pkgsinfo and catalog-rebuild
+// endpoints require pkgsinfos and catalogs respectively. A nil logger
+// discards RebuildCatalogs' per-item log lines.
+func NewService(manifests munki.ManifestStore, tags munki.TagStore, pkgsinfos munki.PkgsinfoStore, catalogs munki.CatalogStore, logger kitlog.Logger) Service {
+	if logger == nil {
+		logger = kitlog.NewNopLogger()
+	}
+	return &service{manifests: manifests, tags: tags, pkgsinfos: pkgsinfos, catalogs: catalogs, logger: logger}
+}
+
+func (s *service) ListManifests() (*munki.ManifestCollection, error) {
+	return s.manifests.AllManifests()
+}
+
+// ShowManifest resolves path as a literal manifest filename first, then as
+// a registered tag name, then as a sha256 content digest, so a single
+// {path} segment can address a manifest any of the three ways. Whatever it
+// finds is resolved through resolveList, so a client fetching a manifest
+// list gets back a concrete munkiv1 manifest rather than the raw digest
+// list.
+func (s *service) ShowManifest(path string) (munki.Manifest, error) {
+	return s.showManifest(path, make(map[string]bool))
+}
+
+// showManifest is ShowManifest's recursive implementation. visited tracks
+// every tag name already followed on this resolution chain, so a tag that
+// points back into its own chain -- directly or through intermediate tags
+// -- returns an error instead of recursing without bound.
+func (s *service) showManifest(path string, visited map[string]bool) (munki.Manifest, error) {
+	m, err := s.manifests.Manifest(path)
+	if err == nil {
+		return s.resolveList(m)
+	}
+	if err != datastore.ErrNotFound {
+		return nil, err
+	}
+
+	if s.tags != nil {
+		if tag, tagErr := s.tags.Tag(path); tagErr == nil {
+			if visited[path] {
+				return nil, fmt.Errorf("munkiserver: tag %q is part of a cycle", path)
+			}
+			visited[path] = true
+			return s.showManifest(tag.Target, visited)
+		} else if tagErr != datastore.ErrNotFound {
+			return nil, tagErr
+		}
+
+		if looksLikeDigest(path) {
+			m, err := s.tags.ManifestByDigest("sha256:" + strings.TrimPrefix(path, "sha256:"))
+			if err != nil {
+				return nil, err
+			}
+			return s.resolveList(m)
+		}
+	}
+
+	return nil, datastore.ErrNotFound
+}
+
+// resolveList resolves a ManifestList into the munkiv1 manifest it stands
+// for, so callers never need to know a list was involved. Any other
+// schema, including munkiv1 itself, is returned unchanged.
+func (s *service) resolveList(m munki.Manifest) (munki.Manifest, error) {
+	list, ok := m.(*munki.ManifestList)
+	if !ok {
+		return m, nil
+	}
+	if s.tags == nil {
+		return nil, fmt.Errorf("munkiserver: cannot resolve manifest list %q without a TagStore", list.Filename)
+	}
+	return list.Resolve(s.tags)
+}
+
+func (s *service) ShowTag(name string) (*munki.Tag, error) {
+	if s.tags == nil {
+		return nil, datastore.ErrNotFound
+	}
+	return s.tags.Tag(name)
+}
+
+func (s *service) SaveTag(name, target string) (*munki.Tag, error) {
+	if s.tags == nil {
+		return nil, fmt.Errorf("munkiserver: no TagStore configured")
+	}
+	return s.tags.SaveTag(name, target)
+}
+
+func (s *service) DeleteTag(name string) error {
+	if s.tags == nil {
+		return datastore.ErrNotFound
+	}
+	return s.tags.DeleteTag(name)
+}
+
+func (s *service) TagHistory(name string) ([]munki.TagHistoryEntry, error) {
+	if s.tags == nil {
+		return nil, datastore.ErrNotFound
+	}
+	return s.tags.TagHistory(name)
+}
+
+func (s *service) ShowManifestByDigest(digest string) (munki.Manifest, error) {
+	if s.tags == nil {
+		return nil, datastore.ErrNotFound
+	}
+	m, err := s.tags.ManifestByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	return s.resolveList(m)
+}
+
+// looksLikeDigest reports whether path is shaped like a sha256 content
+// digest ("sha256:<64 hex chars>" or the bare 64 hex chars), as opposed to
+// a manifest filename or tag name.
+func looksLikeDigest(path string) bool {
+	hex := strings.TrimPrefix(path, "sha256:")
+	if len(hex) != 64 {
+		return false
+	}
+	for _, r := range hex {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *service) ManifestDigest(path string) (string, error) {
+	return s.manifests.ManifestDigest(path)
+}
+
+func (s *service) CreateManifest(name string, payload *munki.ManifestPayload) (munki.Manifest, error) {
+	m, err := s.manifests.NewManifest(name)
+	if err != nil {
+		return nil, err
+	}
+	v1, err := asManifestV1(m)
+	if err != nil {
+		return nil, err
+	}
+	v1.UpdateFromPayload(payload)
+	if err := s.manifests.SaveManifest(name, v1); err != nil {
+		return nil, err
+	}
+	return v1, nil
+}
+
+func (s *service) CreateManifestFromSchema(name string, m munki.Manifest) (munki.Manifest, error) {
+	if err := s.manifests.SaveManifest(name, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReplaceManifest requires path to already exist -- PUT replaces a
+// manifest, it doesn't create one -- then saves m over it wholesale. m
+// may be any schema registered via munki.RegisterManifestSchema.
+func (s *service) ReplaceManifest(path string, m munki.Manifest) (munki.Manifest, error) {
+	if _, err := s.manifests.Manifest(path); err != nil {
+		return nil, err
+	}
+	if err := s.manifests.SaveManifest(path, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *service) UpdateManifest(path string, payload *munki.ManifestPayload) (munki.Manifest, error) {
+	existing, err := s.manifests.Manifest(path)
+	if err != nil {
+		return nil, err
+	}
+	v1, err := asManifestV1(existing)
+	if err != nil {
+		return nil, err
+	}
+	v1.UpdateFromPayload(payload)
+	if err := s.manifests.SaveManifest(path, v1); err != nil {
+		return nil, err
+	}
+	return v1, nil
+}
+
+func (s *service) DeleteManifest(path string) error {
+	return s.manifests.DeleteManifest(path)
+}
+
+// asManifestV1 asserts that m is the mutable default schema. Manifest
+// schemas registered for other media types (e.g. a manifest list) can't be
+// built or merged from a ManifestPayload; the CRUD endpoints only create or
+// replace them whole.
+func asManifestV1(m munki.Manifest) (*munki.ManifestV1, error) {
+	v1, ok := m.(*munki.ManifestV1)
+	if !ok {
+		return nil, fmt.Errorf("munkiserver: manifest is not a mutable munkiv1 schema")
+	}
+	return v1, nil
+}
+
+func (s *service) ListPkgsinfos() (*munki.PkgsinfoCollection, error) {
+	if s.pkgsinfos == nil {
+		return nil, fmt.Errorf("munkiserver: no PkgsinfoStore configured")
+	}
+	return s.pkgsinfos.AllPkgsinfos()
+}
+
+func (s *service) ShowPkgsinfo(path string) (*munki.Pkgsinfo, error) {
+	if s.pkgsinfos == nil {
+		return nil, datastore.ErrNotFound
+	}
+	return s.pkgsinfos.Pkgsinfo(path)
+}
+
+func (s *service) PkgsinfoDigest(path string) (string, error) {
+	if s.pkgsinfos == nil {
+		return "", datastore.ErrNotFound
+	}
+	return s.pkgsinfos.PkgsinfoDigest(path)
+}
+
+func (s *service) CreatePkgsinfo(name string, payload *munki.PkgsinfoPayload) (*munki.Pkgsinfo, error) {
+	if s.pkgsinfos == nil {
+		return nil, fmt.Errorf("munkiserver: no PkgsinfoStore configured")
+	}
+	info, err := s.pkgsinfos.NewPkgsinfo(name)
+	if err != nil {
+		return nil, err
+	}
+	info.UpdateFromPayload(payload)
+	if err := s.pkgsinfos.SavePkgsinfo(name, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (s *service) ReplacePkgsinfo(path string, payload *munki.PkgsinfoPayload) (*munki.Pkgsinfo, error) {
+	if s.pkgsinfos == nil {
+		return nil, fmt.Errorf("munkiserver: no PkgsinfoStore configured")
+	}
+	existing, err := s.pkgsinfos.Pkgsinfo(path)
+	if err != nil {
+		return nil, err
+	}
+	// a replace starts from a blank pkgsinfo with the same filename, same
+	// convention as ReplaceManifest: omitted fields are cleared rather
+	// than left over from the previous version.
+	fresh := &munki.Pkgsinfo{Filename: existing.Filename}
+	fresh.UpdateFromPayload(payload)
+	if err := s.pkgsinfos.SavePkgsinfo(path, fresh); err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
+
+func (s *service) UpdatePkgsinfo(path string, payload *munki.PkgsinfoPayload) (*munki.Pkgsinfo, error) {
+	if s.pkgsinfos == nil {
+		return nil, fmt.Errorf("munkiserver: no PkgsinfoStore configured")
+	}
+	existing, err := s.pkgsinfos.Pkgsinfo(path)
+	if err != nil {
+		return nil, err
+	}
+	existing.UpdateFromPayload(payload)
+	if err := s.pkgsinfos.SavePkgsinfo(path, existing); err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+func (s *service) DeletePkgsinfo(path string) error {
+	if s.pkgsinfos == nil {
+		return datastore.ErrNotFound
+	}
+	return s.pkgsinfos.DeletePkgsinfo(path)
+}
+
+// RebuildCatalogs walks every stored pkgsinfo, groups it by the catalogs
+// it declares, and rewrites each affected catalog via s.catalogs --
+// equivalent to running makecatalogs against the whole repo. It is
+// idempotent: rebuilding twice in a row with no pkgsinfo changes reports
+// zero added/removed. Concurrent calls are serialized by rebuildMu so two
+// overlapping requests can't interleave writes to the same catalog.
+func (s *service) RebuildCatalogs() (*munki.CatalogRebuildSummary, error) {
+	if s.pkgsinfos == nil || s.catalogs == nil {
+		return nil, fmt.Errorf("munkiserver: catalog rebuild requires both a PkgsinfoStore and a CatalogStore")
+	}
+	s.rebuildMu.Lock()
+	defer s.rebuildMu.Unlock()
+
+	all, err := s.pkgsinfos.AllPkgsinfos()
+	if err != nil {
+		return nil, err
+	}
+
+	grouped := make(map[string][]*munki.Pkgsinfo)
+	summary := &munki.CatalogRebuildSummary{}
+	for _, info := range *all {
+		if info.Name == "" || info.Version == "" {
+			summary.Errored = append(summary.Errored, info.Filename)
+			s.logger.Log("component", "catalog-rebuild", "pkgsinfo", info.Filename, "err", "missing name or version")
+			continue
+		}
+		for _, cat := range info.Catalogs {
+			grouped[cat] = append(grouped[cat], info)
+		}
+	}
+
+	existingNames, err := s.catalogs.AllCatalogNames()
+	if err != nil {
+		return nil, err
+	}
+	stale := make(map[string]bool, len(existingNames))
+	for _, name := range existingNames {
+		stale[name] = true
+	}
+
+	for name, items := range grouped {
+		delete(stale, name)
+		added, removed, err := s.rebuildCatalog(name, items)
+		if err != nil {
+			return nil, err
+		}
+		summary.Added += added
+		summary.Removed += removed
+	}
+
+	// a catalog that no pkgsinfo references anymore is emptied out rather
+	// than deleted, so clients polling it see it go empty rather than 404.
+	for name := range stale {
+		added, removed, err := s.rebuildCatalog(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		summary.Added += added
+		summary.Removed += removed
+	}
+
+	return summary, nil
+}
+
+// rebuildCatalog diffs name's current contents against items and saves
+// items as the new contents, logging one structured line per pkgsinfo that
+// moved in or out of the catalog, plus a summary line for the catalog as a
+// whole. Callers must hold s.rebuildMu.
+func (s *service) rebuildCatalog(name string, items []*munki.Pkgsinfo) (added, removed int, err error) {
+	before, err := s.catalogs.Catalog(name)
+	if err != nil && err != datastore.ErrNotFound {
+		return 0, 0, err
+	}
+
+	beforeSet := make(map[string]bool, len(before))
+	for _, p := range before {
+		beforeSet[p.Filename] = true
+	}
+	afterSet := make(map[string]bool, len(items))
+	for _, p := range items {
+		afterSet[p.Filename] = true
+		if !beforeSet[p.Filename] {
+			added++
+			s.logger.Log("component", "catalog-rebuild", "catalog", name, "pkgsinfo", p.Filename, "change", "added")
+		}
+	}
+	for _, p := range before {
+		if !afterSet[p.Filename] {
+			removed++
+			s.logger.Log("component", "catalog-rebuild", "catalog", name, "pkgsinfo", p.Filename, "change", "removed")
+		}
+	}
+
+	if err := s.catalogs.SaveCatalog(name, items); err != nil {
+		return 0, 0, err
+	}
+	s.logger.Log("component", "catalog-rebuild", "catalog", name, "items", len(items), "added", added, "removed", removed)
+	return added, removed, nil
+}
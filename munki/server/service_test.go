@@ -0,0 +1,225 @@
+package munkiserver
+
+import (
+	"testing"
+
+	"github.com/micromdm/squirrel/munki/datastore"
+	"github.com/micromdm/squirrel/munki/munki"
+)
+
+// fakePkgsinfoStore is the minimal munki.PkgsinfoStore needed to exercise
+// the pkgsinfo CRUD and catalog-rebuild methods on service.
+type fakePkgsinfoStore struct {
+	byName map[string]*munki.Pkgsinfo
+}
+
+func newFakePkgsinfoStore() *fakePkgsinfoStore {
+	return &fakePkgsinfoStore{byName: make(map[string]*munki.Pkgsinfo)}
+}
+
+func (f *fakePkgsinfoStore) AllPkgsinfos() (*munki.PkgsinfoCollection, error) {
+	var all munki.PkgsinfoCollection
+	for _, p := range f.byName {
+		all = append(all, p)
+	}
+	return &all, nil
+}
+
+func (f *fakePkgsinfoStore) Pkgsinfo(name string) (*munki.Pkgsinfo, error) {
+	p, ok := f.byName[name]
+	if !ok {
+		return nil, datastore.ErrNotFound
+	}
+	return p, nil
+}
+
+func (f *fakePkgsinfoStore) NewPkgsinfo(name string) (*munki.Pkgsinfo, error) {
+	return &munki.Pkgsinfo{Filename: name}, nil
+}
+
+func (f *fakePkgsinfoStore) SavePkgsinfo(path string, info *munki.Pkgsinfo) error {
+	info.Filename = path
+	f.byName[path] = info
+	return nil
+}
+
+func (f *fakePkgsinfoStore) DeletePkgsinfo(name string) error {
+	if _, ok := f.byName[name]; !ok {
+		return datastore.ErrNotFound
+	}
+	delete(f.byName, name)
+	return nil
+}
+
+func (f *fakePkgsinfoStore) PkgsinfoDigest(name string) (string, error) {
+	p, ok := f.byName[name]
+	if !ok {
+		return "", datastore.ErrNotFound
+	}
+	return p.Digest()
+}
+
+// fakeCatalogStore is the minimal munki.CatalogStore needed to exercise
+// service.RebuildCatalogs.
+type fakeCatalogStore struct {
+	byName map[string][]*munki.Pkgsinfo
+}
+
+func newFakeCatalogStore() *fakeCatalogStore {
+	return &fakeCatalogStore{byName: make(map[string][]*munki.Pkgsinfo)}
+}
+
+func (f *fakeCatalogStore) Catalog(name string) ([]*munki.Pkgsinfo, error) {
+	items, ok := f.byName[name]
+	if !ok {
+		return nil, datastore.ErrNotFound
+	}
+	return items, nil
+}
+
+func (f *fakeCatalogStore) SaveCatalog(name string, items []*munki.Pkgsinfo) error {
+	f.byName[name] = items
+	return nil
+}
+
+func (f *fakeCatalogStore) AllCatalogNames() ([]string, error) {
+	names := make([]string, 0, len(f.byName))
+	for name := range f.byName {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// fakeManifestStore is a munki.ManifestStore with no manifests, so
+// resolution always falls through to the tag store.
+type fakeManifestStore struct{}
+
+func (f *fakeManifestStore) AllManifests() (*munki.ManifestCollection, error) { return nil, nil }
+func (f *fakeManifestStore) Manifest(name string) (munki.Manifest, error) {
+	return nil, datastore.ErrNotFound
+}
+func (f *fakeManifestStore) NewManifest(name string) (munki.Manifest, error) {
+	return nil, datastore.ErrNotFound
+}
+func (f *fakeManifestStore) SaveManifest(path string, m munki.Manifest) error { return nil }
+func (f *fakeManifestStore) DeleteManifest(name string) error                 { return nil }
+func (f *fakeManifestStore) ManifestDigest(name string) (string, error) {
+	return "", datastore.ErrNotFound
+}
+
+// fakeTagStore is the minimal munki.TagStore needed to exercise
+// ShowManifest's tag-chain resolution.
+type fakeTagStore struct {
+	byName map[string]*munki.Tag
+}
+
+func newFakeTagStore() *fakeTagStore { return &fakeTagStore{byName: make(map[string]*munki.Tag)} }
+
+func (f *fakeTagStore) Tag(name string) (*munki.Tag, error) {
+	tag, ok := f.byName[name]
+	if !ok {
+		return nil, datastore.ErrNotFound
+	}
+	return tag, nil
+}
+
+func (f *fakeTagStore) SaveTag(name, target string) (*munki.Tag, error) {
+	tag := &munki.Tag{Name: name, Target: target}
+	f.byName[name] = tag
+	return tag, nil
+}
+
+func (f *fakeTagStore) DeleteTag(name string) error {
+	delete(f.byName, name)
+	return nil
+}
+
+func (f *fakeTagStore) TagHistory(name string) ([]munki.TagHistoryEntry, error) { return nil, nil }
+
+func (f *fakeTagStore) ManifestByDigest(digest string) (munki.Manifest, error) {
+	return nil, datastore.ErrNotFound
+}
+
+func TestServiceShowManifestDetectsTagCycle(t *testing.T) {
+	tags := newFakeTagStore()
+	tags.byName["a"] = &munki.Tag{Name: "a", Target: "b"}
+	tags.byName["b"] = &munki.Tag{Name: "b", Target: "a"}
+	svc := NewService(&fakeManifestStore{}, tags, nil, nil, nil)
+
+	if _, err := svc.ShowManifest("a"); err == nil {
+		t.Fatal("ShowManifest on a tag cycle returned no error, want a cycle error")
+	}
+}
+
+func TestServiceCreateAndShowPkgsinfo(t *testing.T) {
+	pkgsinfos := newFakePkgsinfoStore()
+	svc := NewService(nil, nil, pkgsinfos, nil, nil)
+
+	name := "Firefox-100.0.plist"
+	version := "100.0"
+	payload := &munki.PkgsinfoPayload{Name: &name, Version: &version}
+	created, err := svc.CreatePkgsinfo("Firefox-100.0.plist", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Name != "Firefox-100.0.plist" {
+		t.Errorf("Name = %q, want %q", created.Name, "Firefox-100.0.plist")
+	}
+
+	shown, err := svc.ShowPkgsinfo("Firefox-100.0.plist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shown.Version != "100.0" {
+		t.Errorf("Version = %q, want %q", shown.Version, "100.0")
+	}
+}
+
+func TestServiceRebuildCatalogsAddsAndRemoves(t *testing.T) {
+	pkgsinfos := newFakePkgsinfoStore()
+	catalogs := newFakeCatalogStore()
+	svc := NewService(nil, nil, pkgsinfos, catalogs, nil).(*service)
+
+	firefox := &munki.Pkgsinfo{Filename: "firefox", Name: "Firefox", Version: "100.0", Catalogs: []string{"production"}}
+	pkgsinfos.byName["firefox"] = firefox
+	broken := &munki.Pkgsinfo{Filename: "broken"}
+	pkgsinfos.byName["broken"] = broken
+
+	summary, err := svc.RebuildCatalogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Added != 1 {
+		t.Errorf("Added = %d, want 1", summary.Added)
+	}
+	if len(summary.Errored) != 1 || summary.Errored[0] != "broken" {
+		t.Errorf("Errored = %v, want [broken]", summary.Errored)
+	}
+
+	// rebuilding again with no pkgsinfo changes is idempotent.
+	summary, err = svc.RebuildCatalogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Added != 0 || summary.Removed != 0 {
+		t.Errorf("second rebuild summary = %+v, want zero added/removed", summary)
+	}
+
+	// dropping firefox's catalog membership empties the catalog rather
+	// than leaving the stale entry behind.
+	firefox.Catalogs = nil
+	summary, err = svc.RebuildCatalogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Removed != 1 {
+		t.Errorf("Removed = %d, want 1", summary.Removed)
+	}
+	remaining, err := catalogs.Catalog("production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("production catalog = %v, want empty", remaining)
+	}
+}
@@ -0,0 +1,170 @@
+package munkiserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/gorilla/mux"
+	"github.com/micromdm/squirrel/munki/munki"
+	"golang.org/x/net/context"
+)
+
+// tagResponse wraps a Tag for the JSON/XML envelope.
+type tagResponse struct {
+	*munki.Tag
+	err error
+}
+
+func (r tagResponse) error() error { return r.err }
+
+// tagHistoryResponse unwraps to the bare history slice via subsetEncoder.
+type tagHistoryResponse struct {
+	History []munki.TagHistoryEntry
+	err     error
+}
+
+func (r tagHistoryResponse) error() error        { return r.err }
+func (r tagHistoryResponse) subset() interface{} { return r.History }
+
+func tagVar(r *http.Request) (string, error) {
+	tag, ok := mux.Vars(r)["tag"]
+	if !ok {
+		return "", errBadRouting
+	}
+	return tag, nil
+}
+
+// --- show tag ---
+
+type showTagRequest struct {
+	Name string
+}
+
+func decodeShowTagRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	name, err := tagVar(r)
+	if err != nil {
+		return nil, err
+	}
+	return showTagRequest{Name: name}, nil
+}
+
+func makeShowTagEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(showTagRequest)
+		tag, err := svc.ShowTag(req.Name)
+		return tagResponse{Tag: tag, err: err}, nil
+	}
+}
+
+// --- save (PUT) tag ---
+
+type saveTagRequest struct {
+	Name   string
+	Target string `json:"target"`
+}
+
+func decodeSaveTagRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	name, err := tagVar(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Body == nil {
+		return nil, errEmptyRequest
+	}
+	var req saveTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	if req.Target == "" {
+		return nil, errEmptyRequest
+	}
+	req.Name = name
+	return req, nil
+}
+
+func makeSaveTagEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(saveTagRequest)
+		tag, err := svc.SaveTag(req.Name, req.Target)
+		return tagResponse{Tag: tag, err: err}, nil
+	}
+}
+
+// --- delete tag ---
+
+type deleteTagRequest struct {
+	Name string
+}
+
+func decodeDeleteTagRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	name, err := tagVar(r)
+	if err != nil {
+		return nil, err
+	}
+	return deleteTagRequest{Name: name}, nil
+}
+
+func makeDeleteTagEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(deleteTagRequest)
+		if err := svc.DeleteTag(req.Name); err != nil {
+			return statusResponse{err: err}, nil
+		}
+		return statusResponse{httpStatus: http.StatusNoContent}, nil
+	}
+}
+
+// --- tag history ---
+
+type tagHistoryRequest struct {
+	Name string
+}
+
+func decodeTagHistoryRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	name, err := tagVar(r)
+	if err != nil {
+		return nil, err
+	}
+	return tagHistoryRequest{Name: name}, nil
+}
+
+func makeTagHistoryEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(tagHistoryRequest)
+		history, err := svc.TagHistory(req.Name)
+		if err != nil {
+			return tagHistoryResponse{err: err}, nil
+		}
+		return tagHistoryResponse{History: history}, nil
+	}
+}
+
+// --- show manifest by digest ---
+
+type showManifestByDigestRequest struct {
+	Digest string
+}
+
+func decodeShowManifestByDigestRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	digest, ok := mux.Vars(r)["sha256"]
+	if !ok {
+		return nil, errBadRouting
+	}
+	return showManifestByDigestRequest{Digest: "sha256:" + digest}, nil
+}
+
+func makeShowManifestByDigestEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(showManifestByDigestRequest)
+		m, err := svc.ShowManifestByDigest(req.Digest)
+		if err != nil {
+			return manifestResponse{err: err}, nil
+		}
+		digest, err := munki.Digest(m)
+		if err != nil {
+			return manifestResponse{err: err}, nil
+		}
+		return manifestResponse{Manifest: m, digest: digest}, nil
+	}
+}
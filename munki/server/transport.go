@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
 
 	kitlog "github.com/go-kit/kit/log"
 	httptransport "github.com/go-kit/kit/transport/http"
@@ -11,6 +12,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/groob/plist"
 	"github.com/micromdm/squirrel/munki/datastore"
+	"github.com/micromdm/squirrel/munki/munki"
 
 	"golang.org/x/net/context"
 )
@@ -19,6 +21,10 @@ var (
 	// ErrEmptyRequest is returned if the request body is empty
 	errEmptyRequest = errors.New("request must contain all required fields")
 	errBadRouting   = errors.New("inconsistent mapping between route and handler (programmer error)")
+	// errPreconditionFailed is returned when a mutation request's If-Match
+	// header does not match, or its If-None-Match header does match, the
+	// stored manifest's or pkgsinfo's current ETag.
+	errPreconditionFailed = errors.New("precondition failed")
 )
 
 // ServiceHandler creates an HTTP handler for the munki Service
@@ -52,21 +58,21 @@ func ServiceHandler(ctx context.Context, svc Service, logger kitlog.Logger) http
 	deleteManifestHandler := kithttp.NewServer(
 		ctx,
 		makeDeleteManifestEndpoint(svc),
-		decodeDeleteManifestRequest,
+		decodeDeleteManifestRequest(svc),
 		encodeResponse,
 		opts...,
 	)
 	replaceManifestHandler := kithttp.NewServer(
 		ctx,
 		makeReplaceManifestEndpoint(svc),
-		decodeReplaceManifestRequest,
+		decodeReplaceManifestRequest(svc),
 		encodeResponse,
 		opts...,
 	)
 	updateManifestHandler := kithttp.NewServer(
 		ctx,
 		makeUpdateManifestEndpoint(svc),
-		decodeUpdateManifestRequest,
+		decodeUpdateManifestRequest(svc),
 		encodeResponse,
 		opts...,
 	)
@@ -84,23 +90,117 @@ func ServiceHandler(ctx context.Context, svc Service, logger kitlog.Logger) http
 		encodeResponse,
 		opts...,
 	)
+	showPkgsinfoHandler := kithttp.NewServer(
+		ctx,
+		makeShowPkgsinfoEndpoint(svc),
+		decodeShowPkgsinfoRequest,
+		encodeResponse,
+		opts...,
+	)
+	// replace/update/delete use checkPrecondition against the pkgsinfo's
+	// digest, same as the manifest mutation handlers, so callers can use
+	// If-Match/If-None-Match to detect drift before writing.
+	replacePkgsinfoHandler := kithttp.NewServer(
+		ctx,
+		makeReplacePkgsinfoEndpoint(svc),
+		decodeReplacePkgsinfoRequest(svc),
+		encodeResponse,
+		opts...,
+	)
+	updatePkgsinfoHandler := kithttp.NewServer(
+		ctx,
+		makeUpdatePkgsinfoEndpoint(svc),
+		decodeUpdatePkgsinfoRequest(svc),
+		encodeResponse,
+		opts...,
+	)
+	deletePkgsinfoHandler := kithttp.NewServer(
+		ctx,
+		makeDeletePkgsinfoEndpoint(svc),
+		decodeDeletePkgsinfoRequest(svc),
+		encodeResponse,
+		opts...,
+	)
+	rebuildCatalogsHandler := kithttp.NewServer(
+		ctx,
+		makeRebuildCatalogsEndpoint(svc),
+		decodeRebuildCatalogsRequest,
+		encodeResponse,
+		opts...,
+	)
+	showTagHandler := kithttp.NewServer(
+		ctx,
+		makeShowTagEndpoint(svc),
+		decodeShowTagRequest,
+		encodeResponse,
+		opts...,
+	)
+	saveTagHandler := kithttp.NewServer(
+		ctx,
+		makeSaveTagEndpoint(svc),
+		decodeSaveTagRequest,
+		encodeResponse,
+		opts...,
+	)
+	deleteTagHandler := kithttp.NewServer(
+		ctx,
+		makeDeleteTagEndpoint(svc),
+		decodeDeleteTagRequest,
+		encodeResponse,
+		opts...,
+	)
+	tagHistoryHandler := kithttp.NewServer(
+		ctx,
+		makeTagHistoryEndpoint(svc),
+		decodeTagHistoryRequest,
+		encodeResponse,
+		opts...,
+	)
+	showManifestByDigestHandler := kithttp.NewServer(
+		ctx,
+		makeShowManifestByDigestEndpoint(svc),
+		decodeShowManifestByDigestRequest,
+		encodeResponse,
+		opts...,
+	)
 
 	r := mux.NewRouter()
 
-	r.Handle("/api/v1/manifests/{path}", showManifestHandler).Methods("GET")
+	// showManifestHandler also transparently resolves a {path} that looks
+	// like a sha256 digest or a registered tag name, in addition to a
+	// literal manifest filename.
+	r.Handle("/api/v1/manifests/{path}", showManifestHandler).Methods("GET", "HEAD")
 	r.Handle("/api/v1/manifests", listManifestsHandler).Methods("GET")
 	r.Handle("/api/v1/manifests", createManifestHandler).Methods("POST")
 	r.Handle("/api/v1/manifests/{path}", deleteManifestHandler).Methods("DELETE")
 	r.Handle("/api/v1/manifests/{path}", replaceManifestHandler).Methods("PUT")
 	r.Handle("/api/v1/manifests/{path}", updateManifestHandler).Methods("PATCH")
 
+	r.Handle("/api/v1/manifests/tags/{tag}", showTagHandler).Methods("GET")
+	r.Handle("/api/v1/manifests/tags/{tag}", saveTagHandler).Methods("PUT")
+	r.Handle("/api/v1/manifests/tags/{tag}", deleteTagHandler).Methods("DELETE")
+	r.Handle("/api/v1/manifests/tags/{tag}/history", tagHistoryHandler).Methods("GET")
+	r.Handle("/api/v1/manifests/by-digest/{sha256}", showManifestByDigestHandler).Methods("GET")
+
+	r.Handle("/api/v1/pkgsinfos/{path}", showPkgsinfoHandler).Methods("GET")
+	r.Handle("/api/v1/pkgsinfos/{path}", replacePkgsinfoHandler).Methods("PUT")
+	r.Handle("/api/v1/pkgsinfos/{path}", updatePkgsinfoHandler).Methods("PATCH")
+	r.Handle("/api/v1/pkgsinfos/{path}", deletePkgsinfoHandler).Methods("DELETE")
+	// rebuildCatalogsHandler walks every stored pkgsinfo and regenerates
+	// catalogs/, equivalent to running makecatalogs. The service layer
+	// serializes concurrent rebuilds so two overlapping requests can't
+	// interleave writes to the same catalog file.
+	r.Handle("/api/v1/catalogs/rebuild", rebuildCatalogsHandler).Methods("POST")
+
 	r.Handle("/api/v1/pkgsinfos", listPkgsinfosHandler).Methods("GET")
 	r.Handle("/api/v1/pkgsinfos", createPkgsinfoHandler).Methods("POST")
 	return r
 }
 
 func updateContext(ctx context.Context, r *http.Request) context.Context {
-	return context.WithValue(ctx, "mediaType", acceptHeader(r))
+	ctx = context.WithValue(ctx, "mediaType", acceptHeader(r))
+	ctx = context.WithValue(ctx, "method", r.Method)
+	return ctx
 }
 
 // if header is not set to json or xml, return json header
@@ -138,6 +238,12 @@ type subsetEncoder interface {
 	subset() interface{}
 }
 
+// headerer is implemented by responses that need to set extra headers
+// (Content-Digest, ETag) before the status line and body are written.
+type headerer interface {
+	headers() map[string]string
+}
+
 func encodeJSON(w http.ResponseWriter, from interface{}) error {
 	data, err := json.MarshalIndent(from, "", "  ")
 	if err != nil {
@@ -160,6 +266,11 @@ func encodeResponse(ctx context.Context, w http.ResponseWriter, response interfa
 	}
 	mediaType := ctx.Value("mediaType").(string)
 	setContentType(w, mediaType)
+	if h, ok := response.(headerer); ok {
+		for k, v := range h.headers() {
+			w.Header().Set(k, v)
+		}
+	}
 	// for success responses
 	if e, ok := response.(statuser); ok {
 		w.WriteHeader(e.status())
@@ -168,6 +279,22 @@ func encodeResponse(ctx context.Context, w http.ResponseWriter, response interfa
 		}
 	}
 
+	// HEAD requests report the same headers as GET but never write a body
+	if method, ok := ctx.Value("method").(string); ok && method == "HEAD" {
+		return nil
+	}
+
+	// a Manifest writes itself: its registered schema, not the Accept
+	// header, decides the wire format.
+	if m, ok := response.(munki.Manifest); ok {
+		_, data, err := m.Payload()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
 	// check if this is a collection
 	if e, ok := response.(subsetEncoder); ok {
 		response = e.subset()
@@ -178,6 +305,38 @@ func encodeResponse(ctx context.Context, w http.ResponseWriter, response interfa
 	return encodeJSON(w, response)
 }
 
+// matchesETag reports whether etag satisfies the comma-separated list of
+// entity tags in header, per RFC 7232 (a "*" matches any current etag).
+func matchesETag(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPrecondition enforces If-Match / If-None-Match on a mutation request
+// against the current ETag of the resource being modified. It returns
+// errPreconditionFailed when the request's precondition does not hold,
+// letting decode funcs for PUT/PATCH/DELETE reject stale or conflicting
+// writes before they reach the service layer.
+func checkPrecondition(r *http.Request, etag string) error {
+	if im := r.Header.Get("If-Match"); im != "" && !matchesETag(im, etag) {
+		return errPreconditionFailed
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && matchesETag(inm, etag) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
 func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
@@ -199,6 +358,8 @@ func codeFrom(err error) int {
 	switch err {
 	case datastore.ErrNotFound:
 		return http.StatusNotFound
+	case errPreconditionFailed:
+		return http.StatusPreconditionFailed
 	default:
 		if e, ok := err.(httptransport.Error); ok {
 			switch e.Domain {
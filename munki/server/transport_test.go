@@ -0,0 +1,92 @@
+package munkiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/micromdm/squirrel/munki/munki"
+	"golang.org/x/net/context"
+)
+
+func TestMatchesETag(t *testing.T) {
+	cases := []struct {
+		header string
+		etag   string
+		want   bool
+	}{
+		{"", `"abc"`, false},
+		{"*", `"abc"`, true},
+		{`"abc"`, `"abc"`, true},
+		{`"abc", "def"`, `"def"`, true},
+		{`"abc"`, `"def"`, false},
+	}
+	for _, c := range cases {
+		if got := matchesETag(c.header, c.etag); got != c.want {
+			t.Errorf("matchesETag(%q, %q) = %v, want %v", c.header, c.etag, got, c.want)
+		}
+	}
+}
+
+func TestCheckPrecondition(t *testing.T) {
+	cases := []struct {
+		name        string
+		ifMatch     string
+		ifNoneMatch string
+		etag        string
+		wantErr     bool
+	}{
+		{name: "no headers", etag: `"abc"`},
+		{name: "if-match hit", ifMatch: `"abc"`, etag: `"abc"`},
+		{name: "if-match miss", ifMatch: `"abc"`, etag: `"def"`, wantErr: true},
+		{name: "if-none-match hit is a conflict", ifNoneMatch: `"abc"`, etag: `"abc"`, wantErr: true},
+		{name: "if-none-match miss is fine", ifNoneMatch: `"abc"`, etag: `"def"`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/api/v1/manifests/site-a", nil)
+			if c.ifMatch != "" {
+				r.Header.Set("If-Match", c.ifMatch)
+			}
+			if c.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", c.ifNoneMatch)
+			}
+			err := checkPrecondition(r, c.etag)
+			if (err != nil) != c.wantErr {
+				t.Errorf("checkPrecondition() error = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+// TestEncodeResponsePkgsinfoWritesJSON guards against pkgsinfoResponse
+// accidentally satisfying munki.Manifest (its Pkgsinfo field has the same
+// Payload() signature as a Manifest): encodeResponse must fall through to
+// its normal JSON encoding for a pkgsinfo response with the default Accept,
+// not write raw plist bytes under a JSON Content-Type.
+func TestEncodeResponsePkgsinfoWritesJSON(t *testing.T) {
+	resp := pkgsinfoResponse{
+		Pkgsinfo: &munki.Pkgsinfo{Name: "Firefox", Version: "1.0"},
+		digest:   "sha256:deadbeef",
+	}
+
+	ctx := context.WithValue(context.Background(), "mediaType", "application/json")
+	ctx = context.WithValue(ctx, "method", http.MethodGet)
+	w := httptest.NewRecorder()
+
+	if err := encodeResponse(ctx, w, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded munki.Pkgsinfo
+	if err := json.Unmarshal(w.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("response body is not JSON: %v\nbody: %s", err, w.Body.String())
+	}
+	if decoded.Name != "Firefox" || decoded.Version != "1.0" {
+		t.Errorf("decoded = %+v, want Name=Firefox Version=1.0", decoded)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want application/json; charset=utf-8", ct)
+	}
+}